@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	tencentcloud_cls_sdk_go "github.com/tencentcloud/tencentcloud-cls-sdk-go"
@@ -19,27 +28,256 @@ type ClientConfig struct {
 	TopicID      string
 	InstanceInfo string
 
+	// SecurityToken is the token of temporary STS credentials.
+	// It is read once at startup and is not refreshed.
+	SecurityToken string
+
+	// SecretIDFile and SecretKeyFile are the files the credentials were read from, if any.
+	SecretIDFile  string
+	SecretKeyFile string
+
 	AppendContainerDetailsKeys []string
 	ContainerDetails           *ContainerDetails
 
+	// ContainerDetailsMode is how the container details are added: "flat" (default)
+	// adds a __container_details__.<key> field per key, "nested" adds a single
+	// __container_details__ field holding a JSON object.
+	ContainerDetailsMode string
+
 	// Retries is the number of retries to call the Tencent CLS API.
 	Retries int
 
+	// RetryInitialInterval is the wait before the first retry of a batch,
+	// doubled on every retry up to RetryMaxInterval.
+	// Zero keeps the producer defaults of 100ms and 50s.
+	RetryInitialInterval time.Duration
+	RetryMaxInterval     time.Duration
+
+	// Compress is the compression of the uploads, "lz4" (default) or "zstd".
+	// It is set by the cls-compress option, as the Docker compress option
+	// compresses the rotated log files.
+	Compress string
+
+	// BatchMaxBytes is the size in bytes from which the producer uploads
+	// a batch without waiting for it to linger. Zero keeps the producer default of 512KB.
+	BatchMaxBytes int64
+	// BatchMaxMessages is the number of logs from which the producer uploads
+	// a batch without waiting for it to linger. Zero keeps the producer default of 4096.
+	BatchMaxMessages int
+
+	// Proxy is the URL of the proxy to upload the logs through.
+	// Empty uses the proxy of the HTTP_PROXY and NO_PROXY environment variables.
+	Proxy string
+
+	// ShareProducer shares the producer, its connections and its buffer,
+	// with the other containers having the same connection and producer
+	// options, instead of creating one per container.
+	ShareProducer bool
+
 	// Timeout is the timeout for the HTTP Client.
 	// Valid time units are "ns", "us" (or "µs"), "ms", "s", "m", "h".
 	Timeout time.Duration
+
+	// Mode is the Docker log delivery mode, "blocking" (default) or "non-blocking".
+	// In non-blocking mode a log is dropped right away when the producer buffer is full.
+	// An explicit blocking mode waits for room in the buffer without dropping the log,
+	// unless EnqueueTimeout is set.
+	Mode string
+
+	// Ordering is "none" (default) to let the producer upload batches
+	// concurrently, or "per-container" to upload them one at a time so logs
+	// reach Tencent CLS in the order the container wrote them.
+	// Batches retried after a failure may still arrive out of order.
+	Ordering string
+
+	// OwnerLabel is the container label holding the owner or team of the container,
+	// added as the __owner__ field.
+	OwnerLabel string
+
+	// TopicLabel is the container label holding the topic ID to send the logs to
+	// instead of TopicID. TopicID is used when the container lacks the label.
+	TopicLabel string
+
+	// FanoutTopics are the topic IDs every log is mirrored to
+	// in addition to the topic it is routed to.
+	FanoutTopics []string
+
+	// RedactFields are the fields, parsed from JSON logs, whose values
+	// are masked before the logs are sent.
+	RedactFields []string
+
+	// CallerFields are the candidate fields, parsed from JSON logs, holding the
+	// source location of the log, added as the __caller__ field. The first
+	// candidate present is used. A candidate joining fields with ":", e.g.
+	// "file:line", requires all of them and joins their values the same way.
+	CallerFields []string
+
+	// EnqueueTimeout is the maximum time to wait for room in the producer buffer
+	// before the log is dropped. Zero waits forever, nil keeps the SDK default.
+	EnqueueTimeout *time.Duration
+
+	// OutputSink is where the logs are written to: "cls" (default)
+	// or "stdout-json" to write them to the plugin's stdout instead.
+	OutputSink string
+
+	// CloseTimeout is the maximum time to wait for the producer
+	// to send buffered logs when the client is closed.
+	CloseTimeout time.Duration
+
+	// AppendK8sPodUID adds the Kubernetes pod UID as the __k8s_pod_uid__ field.
+	AppendK8sPodUID bool
+
+	// AppendSource adds the stream the log was written to, "stdout" or "stderr",
+	// as the __source__ field.
+	AppendSource bool
+
+	// EmitBufferDepth adds the number of logs queued in the producer
+	// and not yet acknowledged by Tencent CLS as the __buffer_depth__ field.
+	EmitBufferDepth bool
+
+	// EmitIngestLatency adds the delay between the log timestamp
+	// and the time it is sent as the __ingest_latency_ms__ field.
+	EmitIngestLatency bool
+
+	// EmitSizeBucket adds the size range of the raw log line,
+	// one of sizeBuckets, as the __size_bucket__ field.
+	EmitSizeBucket bool
+
+	// EmitDockerTruncation adds whether Docker split the log into
+	// partial messages, which were reassembled, as the __docker_chunked__ field.
+	EmitDockerTruncation bool
+
+	// EmitLogMode adds the Docker log delivery mode, "blocking" or "non-blocking",
+	// as the __log_mode__ field.
+	EmitLogMode bool
+
+	// RawFieldName is the field the logs which aren't JSON objects are sent in.
+	// Empty uses the __original_text__ field.
+	RawFieldName string
+
+	// IncludeRaw sends the parsed logs as is in the raw field instead of the
+	// __original_text__ field, so the raw field can be indexed as full text with
+	// the parsed fields as key-value. The parsed logs with a field of the name
+	// of the raw field are kept in the __original_text__ field.
+	IncludeRaw bool
+
+	// FieldPrefix replaces the leading "__" of the fields added by the driver,
+	// e.g. cls_ sends __hostname__ as cls_hostname__. Empty uses defaultFieldPrefix.
+	FieldPrefix string
+
+	// StaticFields are added to every log.
+	StaticFields map[string]string
+
+	// OmitHostname drops the __hostname__ field.
+	OmitHostname bool
+	// Hostname is the __hostname__ field value. Empty uses the hostname of the host.
+	Hostname string
+
+	// MaxFields is the maximum number of fields parsed from a log, beyond which
+	// the remaining fields are sent as a JSON object in the __overflow__ field.
+	// Zero disables the limit.
+	MaxFields int
+
+	// ParseFormat is the format the log text is parsed into fields from:
+	// "json" (default), "logfmt", or "none" to always send it as is in the raw field.
+	// The logs which fail to parse are sent as is in the raw field.
+	ParseFormat string
+
+	// FlattenJSON flattens the nested objects and arrays of JSON logs
+	// into fields named by their dotted path, e.g. http.status.
+	FlattenJSON bool
+
+	// TimestampLocation is the time zone of the container_created detail.
+	// Nil uses UTC.
+	TimestampLocation *time.Location
+
+	// VerifyCredentials fails NewClient when Tencent CLS rejects the credentials,
+	// instead of dropping every log.
+	VerifyCredentials bool
+
+	// TimePrecision is the precision of the log time sent to Tencent CLS:
+	// "s" (default) or "ms", keeping the order of the logs within a second.
+	TimePrecision string
+
+	// PartitionField is the granularity, "hour" or "day", of the time partition
+	// of the log added as the __partition__ field. Empty disables the field.
+	PartitionField string
+}
+
+// validateEndpoint checks the endpoint is a bare host[:port],
+// which the producer sends to over HTTP.
+func validateEndpoint(endpoint string) error {
+	u, err := url.Parse("//" + endpoint)
+	if err != nil || u.Host != endpoint || u.Hostname() == "" {
+		return fmt.Errorf("invalid endpoint %q: must be a host[:port] without scheme or path", endpoint)
+	}
+	return nil
+}
+
+// String returns the config with the credentials masked, see redacted.
+func (c ClientConfig) String() string {
+	// plain drops the String method to not recurse into it.
+	type plain ClientConfig
+	return fmt.Sprintf("%+v", plain(c.redacted()))
+}
+
+// redacted returns a copy of the config safe to log, with the credentials
+// and the instance info masked. The container details are dropped as their
+// log options hold the credentials too, see redactContainerDetails.
+func (c ClientConfig) redacted() ClientConfig {
+	c.SecretID = maskSecret(c.SecretID)
+	c.SecretKey = maskSecret(c.SecretKey)
+	c.SecurityToken = maskSecret(c.SecurityToken)
+	c.InstanceInfo = maskSecret(c.InstanceInfo)
+	c.Proxy = redactProxy(c.Proxy)
+	c.ContainerDetails = nil
+	return c
+}
+
+// maskSecret masks all but the last 4 characters of a secret.
+// Short secrets are masked entirely.
+func maskSecret(secret string) string {
+	const visible = 4
+	switch {
+	case secret == "":
+		return ""
+	case len(secret) <= 2*visible:
+		return "****"
+	default:
+		return "****" + secret[len(secret)-visible:]
+	}
 }
 
 func (c ClientConfig) Validate() error {
 	var errs []error
 
+	switch c.OutputSink {
+	case "", outputSinkCLS:
+	case outputSinkStdoutJSON:
+		// Nothing is sent to Tencent CLS, so no connection settings are required.
+		return nil
+	default:
+		return fmt.Errorf("unknown output sink %q", c.OutputSink)
+	}
+
 	if c.Endpoint == "" {
 		errs = append(errs, errors.New("endpoint is required"))
+	} else if err := validateEndpoint(c.Endpoint); err != nil {
+		errs = append(errs, err)
 	}
-	if c.SecretID == "" {
+	if c.SecurityToken != "" && (c.SecretID == "" || c.SecretKey == "") {
+		errs = append(errs, errors.New("security token requires both secret ID and secret key"))
+	}
+	switch {
+	case c.SecretID == "" && c.SecretIDFile != "":
+		errs = append(errs, fmt.Errorf("secret ID file %q is empty", c.SecretIDFile))
+	case c.SecretID == "":
 		errs = append(errs, errors.New("secret ID is required"))
 	}
-	if c.SecretKey == "" {
+	switch {
+	case c.SecretKey == "" && c.SecretKeyFile != "":
+		errs = append(errs, fmt.Errorf("secret key file %q is empty", c.SecretKeyFile))
+	case c.SecretKey == "":
 		errs = append(errs, errors.New("secret key is required"))
 	}
 	if c.TopicID == "" {
@@ -49,136 +287,763 @@ func (c ClientConfig) Validate() error {
 	return errors.Join(errs...)
 }
 
+// defaultFieldPrefix is the prefix of the fields added by the driver.
+const defaultFieldPrefix = "__"
+
+func (c ClientConfig) fieldPrefix() string {
+	if c.FieldPrefix == "" {
+		return defaultFieldPrefix
+	}
+	return c.FieldPrefix
+}
+
+// reservedField returns the name of the field added by the driver,
+// e.g. __hostname__ for hostname with the default prefix.
+func (c ClientConfig) reservedField(name string) string {
+	return c.fieldPrefix() + name + "__"
+}
+
+// isReservedField reports whether the field name is of the form __name__,
+// reserved for the fields added by Tencent CLS, or of the form of the fields
+// added by the driver with the field prefix.
+func (c ClientConfig) isReservedField(name string) bool {
+	for _, prefix := range []string{defaultFieldPrefix, c.fieldPrefix()} {
+		if len(name) > len(prefix)+2 && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, "__") {
+			return true
+		}
+	}
+	return false
+}
+
+// originalTextField returns the field the parsed logs are kept in as is,
+// __original_text__ with the default prefix.
+func (c ClientConfig) originalTextField() string {
+	return c.reservedField("original_text")
+}
+
+// rawField returns the field the logs which aren't JSON objects are sent in.
+func (c ClientConfig) rawField() string {
+	if c.RawFieldName == "" {
+		return c.originalTextField()
+	}
+	return c.RawFieldName
+}
+
+// parseLog parses the log text into fields in the configured format.
+func (c ClientConfig) parseLog(text string) map[string]string {
+	switch c.ParseFormat {
+	case parseFormatNone:
+		return map[string]string{c.rawField(): text}
+	case parseFormatLogfmt:
+		return logfmt2LogMap(text, c.rawField(), c.originalTextField())
+	}
+	return text2LogMap(text, c.rawField(), c.originalTextField(), c.FlattenJSON)
+}
+
+// producer is the subset of the Tencent CLS AsyncProducerClient used by Client.
+type producer interface {
+	SendLog(topicID string, log *tencentcloud_cls_sdk_go.Log, callback tencentcloud_cls_sdk_go.CallBack) error
+	Close(timeoutMs int64) error
+}
+
 // Client is a Tencent CLS client.
 // It is used to send messages to a Tencent CLS topic.
 type Client struct {
 	logger   *zap.Logger
 	cfg      ClientConfig
-	producer *tencentcloud_cls_sdk_go.AsyncProducerClient
+	producer producer
 	callback *clsCallback
+
+	// topicID is the topic the logs are sent to, resolved from the
+	// container labels once since they don't change during its lifetime.
+	topicID string
+	// hostname is the __hostname__ field value, resolved once rather than
+	// on every log. Empty drops the field.
+	hostname string
+	// detailFields are the container details fields, marshaled once
+	// since the details don't change during the container lifetime.
+	detailFields map[string]string
+	// mayBlock is whether the producer blocks on a full buffer.
+	mayBlock bool
+	clock    clock
+
+	// pending is the number of logs handed to the producer
+	// which have not been reported by the callback yet.
+	pending atomic.Int64
+	// dropped is the number of logs the producer refused to accept.
+	dropped atomic.Int64
+	// failed is the number of logs the producer failed to upload.
+	failed atomic.Int64
+	// delivered is the number of logs the producer uploaded.
+	delivered atomic.Int64
+	// bytes is the size of the logs the producer accepted.
+	bytes atomic.Int64
+	// backgroundSends is the number of logs waiting in the background
+	// for the producer to have room, see sendLog.
+	backgroundSends atomic.Int64
+}
+
+// maxBackgroundSends is the maximum number of logs waiting in the background
+// for the producer to have room, most of them abandoned by their sender.
+const maxBackgroundSends = 64
+
+var (
+	// errSendAbandoned is returned once the context is done while the producer
+	// is blocked on a full buffer. The producer may still accept the log later.
+	errSendAbandoned = errors.New("send abandoned on a full producer buffer")
+	// errTooManyBackgroundSends is returned instead of waiting for the producer
+	// when maxBackgroundSends logs already wait for it.
+	errTooManyBackgroundSends = errors.New("too many logs waiting for the producer")
+)
+
+// ClientStats are the counters of the logs a Client handed to the producer.
+type ClientStats struct {
+	// Pending is the number of logs not reported by the producer yet.
+	Pending int64
+	// Dropped is the number of logs the producer refused to accept.
+	Dropped int64
+	// Failed is the number of logs the producer failed to upload
+	// after exhausting its retries.
+	Failed int64
+	// Delivered is the number of logs the producer uploaded.
+	Delivered int64
+	// Bytes is the size in bytes of the logs the producer accepted.
+	Bytes int64
 }
 
 // NewClient creates a new Tencent CLS client.
 func NewClient(logger *zap.Logger, cfg ClientConfig, limiterOpts ...ratelimit.Option) (*Client, error) {
+	if cfg.OutputSink == outputSinkStdoutJSON {
+		return newClient(logger, cfg, newJSONLinesProducer(os.Stdout)), nil
+	}
+
+	// 设置要上传日志的主题 ID，替换为您的 Topic ID
+	// 创建异步生产者客户端实例
+	newProducer := newAsyncProducer
+	if cfg.ShareProducer {
+		newProducer = sharedProducers.Acquire
+	}
+	producerInstance, err := newProducer(newProducerConfig(cfg), cfg.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Tencent CLS Client: %w", err)
+	}
+
+	client := newClient(logger, cfg, producerInstance)
+	if cfg.VerifyCredentials {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+		err := client.verifyCredentials(ctx)
+		cancel()
+		if err != nil {
+			_ = client.Close(cfg.CloseTimeout)
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+// newProducerConfig creates the Tencent CLS producer config from the client config.
+func newProducerConfig(cfg ClientConfig) *tencentcloud_cls_sdk_go.AsyncProducerClientConfig {
 	producerConfig := tencentcloud_cls_sdk_go.GetDefaultAsyncProducerClientConfig()
 	producerConfig.Endpoint = cfg.Endpoint
 	producerConfig.AccessKeyID = cfg.SecretID
 	producerConfig.AccessKeySecret = cfg.SecretKey
+	producerConfig.AccessToken = cfg.SecurityToken
 	producerConfig.Timeout = int(cfg.Timeout.Milliseconds())
 	producerConfig.Retries = cfg.Retries
+	producerConfig.CompressType = cfg.Compress
+	if cfg.BatchMaxBytes > 0 {
+		producerConfig.MaxBatchSize = cfg.BatchMaxBytes
+	}
+	if cfg.BatchMaxMessages > 0 {
+		producerConfig.MaxBatchCount = cfg.BatchMaxMessages
+	}
+	if cfg.RetryInitialInterval > 0 {
+		producerConfig.BaseRetryBackoffMs = cfg.RetryInitialInterval.Milliseconds()
+	}
+	if cfg.RetryMaxInterval > 0 {
+		producerConfig.MaxRetryBackoffMs = cfg.RetryMaxInterval.Milliseconds()
+	}
 
-	// 设置要上传日志的主题 ID，替换为您的 Topic ID
-	// 创建异步生产者客户端实例
-	producerInstance, err := tencentcloud_cls_sdk_go.NewAsyncProducerClient(producerConfig)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Tencent CLS Client: %w", err)
+	if cfg.Ordering == orderingPerContainer {
+		// The producer isn't shared with this ordering, so a single send
+		// worker serializes the uploads of the container, at the cost of
+		// waiting for each upload before sending the next batch.
+		producerConfig.MaxSendWorkerCount = 1
+	}
+
+	if cfg.Mode == modeNonBlocking {
+		producerConfig.MaxBlockSec = 0
+	} else if cfg.EnqueueTimeout != nil {
+		// The producer waits in whole seconds, and a negative value blocks forever.
+		producerConfig.MaxBlockSec = int(math.Ceil(cfg.EnqueueTimeout.Seconds()))
+		if *cfg.EnqueueTimeout == 0 {
+			producerConfig.MaxBlockSec = -1
+		}
+	} else if cfg.Mode == modeBlocking {
+		// The container is blocked until the producer makes room for the log.
+		producerConfig.MaxBlockSec = -1
 	}
-	producerInstance.Start()
 
-	return &Client{
+	return producerConfig
+}
+
+func newClient(logger *zap.Logger, cfg ClientConfig, producer producer) *Client {
+	c := &Client{
 		logger:   logger,
 		cfg:      cfg,
-		producer: producerInstance,
-		callback: &clsCallback{
-			logger: logger,
-		},
-	}, nil
+		producer: producer,
+		topicID:  cfg.TopicID,
+		mayBlock: newProducerConfig(cfg).MaxBlockSec != 0,
+		clock:    realClock{},
+	}
+	if !cfg.OmitHostname {
+		c.hostname = cfg.Hostname
+		if c.hostname == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				hostname = err.Error()
+			}
+			c.hostname = hostname
+		}
+	}
+	if cfg.TopicLabel != "" && cfg.ContainerDetails != nil {
+		if topicID := cfg.ContainerDetails.ContainerLabels[cfg.TopicLabel]; topicID != "" {
+			logger.Debug("topic is routed by label", zap.String("label", cfg.TopicLabel), zap.String("topicID", topicID))
+			c.topicID = topicID
+		}
+	}
+	if len(cfg.AppendContainerDetailsKeys) > 0 {
+		c.detailFields = c.containerDetailFields()
+	}
+	c.callback = &clsCallback{
+		logger:    logger,
+		pending:   &c.pending,
+		failed:    &c.failed,
+		delivered: &c.delivered,
+	}
+	return c
 }
 
-func text2LogMap(text string) map[string]string {
+// maxFlattenDepth is the nesting depth below which flattened JSON values
+// are kept as JSON strings instead of being flattened further.
+const maxFlattenDepth = 8
+
+// text2LogMap parses a JSON object log into fields, keeping it as is in the
+// originalField field, or returns the log in the rawField field when it isn't
+// a JSON object. With flatten, nested objects and arrays are flattened into
+// fields named by their dotted path, e.g. {"http":{"status":200}} into http.status=200.
+func text2LogMap(text, rawField, originalField string, flatten bool) map[string]string {
 	var data map[string]any
 	if err := json.Unmarshal([]byte(text), &data); err != nil {
-		return map[string]string{"__original_text__": text}
+		return map[string]string{rawField: text}
 	}
 
 	// Pre-allocate map with estimated capacity to reduce allocations
-	// +1 for the __original_text__ field
+	// +1 for the originalField field
 	result := make(map[string]string, len(data)+1)
-	result["__original_text__"] = text
+	result[originalField] = text
 
-	// Convert all values to strings with optimized type handling
 	for k, v := range data {
-		switch val := v.(type) {
-		case string:
-			result[k] = val
-		case nil:
-			result[k] = ""
-		case bool:
-			if val {
-				result[k] = "true"
-			} else {
-				result[k] = "false"
-			}
-		case float64:
-			// JSON numbers are always float64
-			result[k] = fmt.Sprintf("%.6g", val)
-		default:
-			result[k] = fmt.Sprintf("%v", val)
+		if flatten {
+			flattenValue(result, k, v, 1)
+		} else {
+			result[k] = jsonValueString(v)
 		}
 	}
 	return result
 }
 
+// logfmt2LogMap parses a logfmt log, e.g. `level=info msg="user logged in"`,
+// into fields, or returns the log in the raw field if it isn't logfmt.
+// Like JSON objects, the logfmt logs are kept as is in the originalField field.
+func logfmt2LogMap(text, rawField, originalField string) map[string]string {
+	fields, ok := parseLogfmt(text)
+	if !ok {
+		return map[string]string{rawField: text}
+	}
+	fields[originalField] = text
+	return fields
+}
+
+// parseLogfmt parses the key=value pairs of a logfmt line, unquoting the
+// quoted values. It fails on a line without pairs, a key without a value
+// or an unterminated quoted value.
+func parseLogfmt(text string) (map[string]string, bool) {
+	fields := map[string]string{}
+	for i := 0; i < len(text); {
+		if text[i] == ' ' || text[i] == '\t' {
+			i++
+			continue
+		}
+
+		eq := strings.IndexAny(text[i:], "= \t\"")
+		if eq <= 0 || text[i+eq] != '=' {
+			return nil, false
+		}
+		key := text[i : i+eq]
+		i += eq + 1
+
+		var value string
+		if i < len(text) && text[i] == '"' {
+			end := quotedValueEnd(text, i)
+			if end < 0 {
+				return nil, false
+			}
+			var err error
+			value, err = strconv.Unquote(text[i:end])
+			if err != nil {
+				return nil, false
+			}
+			i = end
+			if i < len(text) && text[i] != ' ' && text[i] != '\t' {
+				return nil, false
+			}
+		} else {
+			end := strings.IndexAny(text[i:], " \t")
+			if end < 0 {
+				end = len(text) - i
+			}
+			value = text[i : i+end]
+			if strings.ContainsAny(value, "=\"") {
+				return nil, false
+			}
+			i += end
+		}
+		fields[key] = value
+	}
+	return fields, len(fields) > 0
+}
+
+// quotedValueEnd returns the index following the closing quote
+// of the quoted value starting at start, or -1 if it is unterminated.
+func quotedValueEnd(text string, start int) int {
+	for i := start + 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// flattenValue adds the value at the path to the fields,
+// recursing into objects and arrays up to maxFlattenDepth.
+func flattenValue(fields map[string]string, path string, v any, depth int) {
+	if depth >= maxFlattenDepth {
+		switch v.(type) {
+		case map[string]any, []any:
+			b, _ := json.Marshal(v)
+			fields[path] = string(b)
+			return
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		for k, child := range val {
+			flattenValue(fields, path+"."+k, child, depth+1)
+		}
+	case []any:
+		for i, child := range val {
+			flattenValue(fields, path+"."+strconv.Itoa(i), child, depth+1)
+		}
+	default:
+		fields[path] = jsonValueString(v)
+	}
+}
+
+// jsonValueString converts a JSON value to a field value.
+func jsonValueString(v any) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case nil:
+		return ""
+	case bool:
+		if val {
+			return "true"
+		}
+		return "false"
+	case float64:
+		// JSON numbers are always float64
+		return fmt.Sprintf("%.6g", val)
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
+
 // SendMessage sends a message to a Tencent CLS.
-func (c *Client) SendMessage(text string) error {
-	addLogMap := text2LogMap(text)
+func (c *Client) SendMessage(msg logMessage) error {
+	return c.SendMessageCtx(context.Background(), msg)
+}
+
+// logTime returns the time of the log in the configured precision.
+func (c *Client) logTime(t time.Time) int64 {
+	if c.cfg.TimePrecision == timePrecisionMillisecond {
+		return t.UnixMilli()
+	}
+	return t.Unix()
+}
+
+// SendMessageCtx sends a message to a Tencent CLS, returning errSendAbandoned
+// with the context error once the context is done if the producer is still
+// blocked on a full buffer. The abandoned log is still sent if the producer
+// accepts it later.
+func (c *Client) SendMessageCtx(ctx context.Context, msg logMessage) error {
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = c.clock.Now()
+	}
+
+	log := tencentcloud_cls_sdk_go.NewCLSLog(c.logTime(msg.Timestamp), c.logMap(msg))
+	err := c.sendLog(ctx, c.topicID, log)
+	for _, topicID := range c.cfg.FanoutTopics {
+		// A topic failing doesn't stop the log from reaching the other ones.
+		err = errors.Join(err, c.sendLog(ctx, topicID, log))
+	}
+
+	return err
+}
+
+func (c *Client) sendLog(ctx context.Context, topicID string, log *tencentcloud_cls_sdk_go.Log) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to send message to topic %q: %w", topicID, err)
+	}
+
+	if ctx.Done() == nil || !c.mayBlock {
+		return c.enqueueLog(topicID, log)
+	}
+
+	// The producer can't be interrupted while it waits for buffer space,
+	// so it's waited for in the background to return when ctx is done.
+	// The abandoned waits are bounded, as each holds a log until the
+	// producer makes room or gives up.
+	if c.backgroundSends.Add(1) > maxBackgroundSends {
+		c.backgroundSends.Add(-1)
+		c.dropped.Add(1)
+		return fmt.Errorf("failed to send message to topic %q: %w", topicID, errTooManyBackgroundSends)
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer c.backgroundSends.Add(-1)
+		done <- c.enqueueLog(topicID, log)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("failed to send message to topic %q: %w: %w", topicID, errSendAbandoned, ctx.Err())
+	}
+}
+
+func (c *Client) enqueueLog(topicID string, log *tencentcloud_cls_sdk_go.Log) error {
+	c.pending.Add(1)
+	err := c.producer.SendLog(topicID, log, c.callback)
+	if err != nil {
+		c.pending.Add(-1)
+		c.dropped.Add(1)
+		return fmt.Errorf("failed to send message to topic %q: %w", topicID, err)
+	}
+	c.bytes.Add(int64(log.Size()))
+
+	return nil
+}
+
+// FieldNames returns the names of the fields added to every log,
+// in addition to the fields parsed from the log text.
+func (c *Client) FieldNames() []string {
+	logMap := c.logMap(logMessage{Timestamp: c.clock.Now()})
+	fields := make([]string, 0, len(logMap))
+	for k := range logMap {
+		fields = append(fields, k)
+	}
+	return fields
+}
+
+// logMap builds the CLS log fields for the message.
+func (c *Client) logMap(msg logMessage) map[string]string {
+	addLogMap := msg.Fields
+	if addLogMap == nil {
+		addLogMap = c.cfg.parseLog(msg.Text)
+	}
+
+	if c.cfg.MaxFields > 0 {
+		c.limitFields(addLogMap)
+	}
+
+	if len(c.cfg.RedactFields) > 0 {
+		redactFields(addLogMap, c.cfg.RedactFields, c.cfg.originalTextField())
+	}
+
+	if c.cfg.IncludeRaw {
+		c.moveOriginalText(addLogMap)
+	}
+
+	maps.Copy(addLogMap, c.cfg.StaticFields)
+
+	if len(c.cfg.CallerFields) > 0 {
+		addLogMap[c.cfg.reservedField("caller")] = caller(addLogMap, c.cfg.CallerFields)
+	}
 
 	if c.cfg.InstanceInfo != "" {
 		instanceInfo := map[string]string{}
 		if err := json.Unmarshal([]byte(c.cfg.InstanceInfo), &instanceInfo); err != nil {
 			c.logger.Debug("failed to unmarshal instance info", zap.String("instanceInfo", c.cfg.InstanceInfo), zap.Error(err))
-			addLogMap["__original_instance__"] = c.cfg.InstanceInfo
+			addLogMap[c.cfg.reservedField("original_instance")] = c.cfg.InstanceInfo
 		} else {
 			for k, v := range instanceInfo {
-				addLogMap["__instance__."+k] = v
+				addLogMap[c.cfg.reservedField("instance")+"."+k] = v
 			}
 		}
 	}
 
-	if len(c.cfg.AppendContainerDetailsKeys) > 0 {
-		for _, k := range c.cfg.AppendContainerDetailsKeys {
-			switch k {
-			case "container_id":
-				addLogMap["__container_details__.container_id"] = c.cfg.ContainerDetails.ContainerID
-			case "container_name":
-				addLogMap["__container_details__.container_name"] = c.cfg.ContainerDetails.ContainerName
-			case "container_image_id":
-				addLogMap["__container_details__.container_image_id"] = c.cfg.ContainerDetails.ContainerImageID
-			case "container_image_name":
-				addLogMap["__container_details__.container_image_name"] = c.cfg.ContainerDetails.ContainerImageName
-			case "container_created":
-				addLogMap["__container_details__.container_created"] = c.cfg.ContainerDetails.ContainerCreated.Format(time.RFC3339)
-			case "container_env":
-				addLogMap["__container_details__.container_env"] = c.mustMarshal(c.cfg.ContainerDetails.ContainerEnv)
-			case "container_labels":
-				addLogMap["__container_details__.container_labels"] = c.mustMarshal(c.cfg.ContainerDetails.ContainerLabels)
-			case "container_entrypoint":
-				addLogMap["__container_details__.container_entrypoint"] = c.cfg.ContainerDetails.ContainerEntrypoint
-			case "container_args":
-				addLogMap["__container_details__.container_args"] = c.mustMarshal(c.cfg.ContainerDetails.ContainerArgs)
-			case "log_path":
-				addLogMap["__container_details__.container_log_path"] = c.cfg.ContainerDetails.LogPath
-			case "daemon_name":
-				addLogMap["__container_details__.daemon_name"] = c.cfg.ContainerDetails.DaemonName
-			case "config":
-				addLogMap["__container_details__.config"] = c.mustMarshal(c.cfg.ContainerDetails.Config)
+	maps.Copy(addLogMap, c.detailFields)
+
+	if c.cfg.OwnerLabel != "" {
+		addLogMap[c.cfg.reservedField("owner")] = containerOwner(c.cfg.ContainerDetails, c.cfg.OwnerLabel)
+	}
+
+	if c.hostname != "" {
+		addLogMap[c.cfg.reservedField("hostname")] = c.hostname
+	}
+
+	if c.cfg.AppendK8sPodUID {
+		addLogMap[c.cfg.reservedField("k8s_pod_uid")] = c.cfg.ContainerDetails.ContainerLabels[k8sPodUIDLabel]
+	}
+
+	if c.cfg.AppendSource {
+		addLogMap[c.cfg.reservedField("source")] = msg.Source
+	}
+
+	if msg.Level != "" {
+		addLogMap[c.cfg.reservedField("level")] = msg.Level
+	}
+
+	if msg.Repeat > 0 {
+		addLogMap[c.cfg.reservedField("repeat")] = strconv.Itoa(msg.Repeat)
+	}
+
+	if c.cfg.EmitBufferDepth {
+		addLogMap[c.cfg.reservedField("buffer_depth")] = strconv.FormatInt(c.pending.Load(), 10)
+	}
+
+	if c.cfg.EmitIngestLatency {
+		addLogMap[c.cfg.reservedField("ingest_latency_ms")] = strconv.FormatInt(c.clock.Now().Sub(msg.Timestamp).Milliseconds(), 10)
+	}
+
+	if layout, ok := partitionLayouts[c.cfg.PartitionField]; ok {
+		addLogMap[c.cfg.reservedField("partition")] = msg.Timestamp.UTC().Format(layout)
+	}
+
+	if c.cfg.EmitLogMode {
+		mode := c.cfg.Mode
+		if mode == "" {
+			mode = modeBlocking
+		}
+		addLogMap[c.cfg.reservedField("log_mode")] = mode
+	}
+
+	if c.cfg.EmitDockerTruncation {
+		addLogMap[c.cfg.reservedField("docker_chunked")] = strconv.FormatBool(msg.Chunks > 0)
+	}
+
+	if c.cfg.EmitSizeBucket {
+		addLogMap[c.cfg.reservedField("size_bucket")] = sizeBucket(msg.Size)
+	}
+
+	return addLogMap
+}
+
+// moveOriginalText moves the redacted text of a parsed log to the raw field,
+// unless a parsed field has the name of the raw field.
+func (c *Client) moveOriginalText(logMap map[string]string) {
+	originalField, rawField := c.cfg.originalTextField(), c.cfg.rawField()
+	text, ok := logMap[originalField]
+	if !ok || rawField == originalField {
+		return
+	}
+	if _, ok := logMap[rawField]; ok {
+		c.logger.Debug("keeping the original text as the raw field is a parsed field", zap.String("field", rawField))
+		return
+	}
+	logMap[rawField] = text
+	delete(logMap, originalField)
+}
+
+// limitFields moves the fields of the log beyond MaxFields, in name order,
+// to the __overflow__ field as a JSON object.
+func (c *Client) limitFields(logMap map[string]string) {
+	names := make([]string, 0, len(logMap))
+	for k := range logMap {
+		if k != c.cfg.originalTextField() {
+			names = append(names, k)
+		}
+	}
+	if len(names) <= c.cfg.MaxFields {
+		return
+	}
+	slices.Sort(names)
+
+	// The __overflow__ field takes the place of the last field kept.
+	extra := names[c.cfg.MaxFields-1:]
+	overflow := make(map[string]string, len(extra))
+	for _, k := range extra {
+		overflow[k] = logMap[k]
+		delete(logMap, k)
+	}
+	logMap[c.cfg.reservedField("overflow")] = c.mustMarshal(overflow)
+	c.logger.Debug("log exceeds the maximum number of fields", zap.Int("fields", len(names)), zap.Int("maxFields", c.cfg.MaxFields))
+}
+
+// caller returns the source location of the log from the first
+// of the candidate fields present, or an empty string if none is.
+func caller(logMap map[string]string, candidates []string) string {
+candidates:
+	for _, candidate := range candidates {
+		fields := strings.Split(candidate, ":")
+		values := make([]string, 0, len(fields))
+		for _, field := range fields {
+			value, ok := logMap[field]
+			if !ok || value == "" {
+				continue candidates
 			}
+			values = append(values, value)
 		}
+		return strings.Join(values, ":")
 	}
+	return ""
+}
 
-	hostname, err := os.Hostname()
-	if err != nil {
-		hostname = err.Error()
+// partitionLayouts are the time layouts of the __partition__ field
+// by partition granularity, in UTC.
+var partitionLayouts = map[string]string{
+	partitionHour: "2006-01-02T15",
+	partitionDay:  "2006-01-02",
+}
+
+// redactedValue replaces the values of the redacted fields.
+const redactedValue = "******"
+
+// redactFields masks the values of the named fields of the log, including in
+// the originalField field the fields were parsed from.
+func redactFields(logMap map[string]string, fields []string, originalField string) {
+	redacted := false
+	for _, field := range fields {
+		if _, ok := logMap[field]; ok {
+			logMap[field] = redactedValue
+			redacted = true
+		}
+	}
+	if !redacted {
+		return
 	}
-	addLogMap["__hostname__"] = hostname
 
-	log := tencentcloud_cls_sdk_go.NewCLSLog(time.Now().Unix(), addLogMap)
-	err = c.producer.SendLog(c.cfg.TopicID, log, c.callback)
-	if err != nil {
-		return fmt.Errorf("failed to send message: %w", err)
+	text, ok := logMap[originalField]
+	if !ok {
+		return
+	}
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(text), &data); err != nil {
+		return
+	}
+	for _, field := range fields {
+		if _, ok := data[field]; ok {
+			data[field] = json.RawMessage(strconv.Quote(redactedValue))
+		}
+	}
+	if redactedText, err := json.Marshal(data); err == nil {
+		logMap[originalField] = string(redactedText)
+	} else {
+		delete(logMap, originalField)
 	}
+}
 
-	return nil
+// sizeBuckets are the upper bounds, exclusive, of the __size_bucket__ ranges.
+// Larger logs fall into the open-ended overflowSizeBucket.
+var sizeBuckets = []struct {
+	limit int
+	name  string
+}{
+	{1 << 10, "0-1k"},
+	{10 << 10, "1k-10k"},
+	{100 << 10, "10k-100k"},
+	{1 << 20, "100k-1m"},
+}
+
+const overflowSizeBucket = "1m+"
+
+func sizeBucket(size int) string {
+	for _, b := range sizeBuckets {
+		if size < b.limit {
+			return b.name
+		}
+	}
+	return overflowSizeBucket
+}
+
+// containerDetailFields returns the log fields of the container details,
+// either a field per detail or a single JSON object in the nested mode.
+func (c *Client) containerDetailFields() map[string]string {
+	details := c.containerDetails()
+	if c.cfg.ContainerDetailsMode == containerDetailsModeNested {
+		return map[string]string{c.cfg.reservedField("container_details"): c.mustMarshal(details)}
+	}
+	fields := make(map[string]string, len(details))
+	for k, v := range details {
+		fields[c.cfg.reservedField("container_details")+"."+k] = v
+	}
+	return fields
+}
+
+// containerDetails returns the container details requested by AppendContainerDetailsKeys.
+func (c *Client) containerDetails() map[string]string {
+	details := make(map[string]string, len(c.cfg.AppendContainerDetailsKeys))
+	for _, k := range c.cfg.AppendContainerDetailsKeys {
+		switch k {
+		case "container_id":
+			// The full ID, unlike the container_id template tag.
+			details["container_id"] = c.cfg.ContainerDetails.ContainerID
+		case "container_short_id":
+			details["container_short_id"] = c.cfg.ContainerDetails.ID()
+		case "container_name":
+			details["container_name"] = c.cfg.ContainerDetails.ContainerName
+		case "container_image_id":
+			details["container_image_id"] = c.cfg.ContainerDetails.ContainerImageID
+		case "container_image_name":
+			details["container_image_name"] = c.cfg.ContainerDetails.ContainerImageName
+		case "container_created":
+			details["container_created"] = formatContainerCreated(c.cfg.ContainerDetails.ContainerCreated, c.cfg.TimestampLocation)
+		case "container_env":
+			details["container_env"] = c.mustMarshal(c.cfg.ContainerDetails.ContainerEnv)
+		case "container_labels":
+			details["container_labels"] = c.mustMarshal(c.cfg.ContainerDetails.ContainerLabels)
+		case "container_entrypoint":
+			details["container_entrypoint"] = c.cfg.ContainerDetails.ContainerEntrypoint
+		case "container_args":
+			details["container_args"] = c.mustMarshal(c.cfg.ContainerDetails.ContainerArgs)
+		case "log_path":
+			details["container_log_path"] = c.cfg.ContainerDetails.LogPath
+		case "daemon_name":
+			details["daemon_name"] = c.cfg.ContainerDetails.DaemonName
+		case "config":
+			details["config"] = c.mustMarshal(c.cfg.ContainerDetails.Config)
+		}
+	}
+	return details
+}
+
+// formatContainerCreated formats the container creation time in the time zone,
+// UTC if nil, or returns an empty string if the time is unknown.
+func formatContainerCreated(created time.Time, loc *time.Location) string {
+	if created.IsZero() {
+		return ""
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	return created.In(loc).Format(time.RFC3339)
 }
 
 func (c *Client) mustMarshal(v any) string {
@@ -190,18 +1055,139 @@ func (c *Client) mustMarshal(v any) string {
 	return string(b)
 }
 
-func (c *Client) Close() error {
-	return c.producer.Close(60000)
+// HealthCheck checks Tencent CLS is reachable and doesn't reject the credentials
+// or the topic of the client, by sending it an upload request without logs.
+func (c *Client) HealthCheck(ctx context.Context) error {
+	if c.cfg.OutputSink == outputSinkStdoutJSON {
+		return nil
+	}
+
+	clsErr, err := c.sendEmptyUpload(ctx)
+	if err != nil {
+		return err
+	}
+	if clsErr == nil {
+		return nil
+	}
+	switch {
+	case clsErr.HTTPCode == http.StatusUnauthorized, clsErr.HTTPCode == http.StatusForbidden, clsErr.HTTPCode == http.StatusNotFound:
+		return fmt.Errorf("credentials or topic %q rejected: %s: %s", c.topicID, clsErr.Code, clsErr.Message)
+	case clsErr.HTTPCode == -1:
+		return fmt.Errorf("failed to reach endpoint: %s", clsErr.Message)
+	case clsErr.HTTPCode >= http.StatusInternalServerError:
+		return fmt.Errorf("endpoint failed with status %d: %s", clsErr.HTTPCode, clsErr.Message)
+	}
+	// Any other response means the request got past authentication,
+	// even if CLS refuses an upload without logs.
+	c.logger.Debug("health check upload was refused", zap.Int32("httpCode", clsErr.HTTPCode), zap.String("code", clsErr.Code))
+	return nil
+}
+
+// verifyCredentials returns an error when Tencent CLS rejects the credentials
+// of the client. Other failures, e.g. an unreachable endpoint, are only logged
+// as the producer retries them.
+func (c *Client) verifyCredentials(ctx context.Context) error {
+	clsErr, err := c.sendEmptyUpload(ctx)
+	if err != nil {
+		return err
+	}
+	if clsErr == nil {
+		return nil
+	}
+	if clsErr.HTTPCode == http.StatusUnauthorized || clsErr.HTTPCode == http.StatusForbidden {
+		return fmt.Errorf("credentials rejected: %s: %s", clsErr.Code, clsErr.Message)
+	}
+	c.logger.Warn("failed to verify credentials", zap.Int32("httpCode", clsErr.HTTPCode), zap.String("code", clsErr.Code), zap.String("message", clsErr.Message))
+	return nil
+}
+
+// sendEmptyUpload sends Tencent CLS an upload request without logs
+// to the topic of the client.
+func (c *Client) sendEmptyUpload(ctx context.Context) (*tencentcloud_cls_sdk_go.CLSError, error) {
+	clsClient, clsErr := tencentcloud_cls_sdk_go.NewCLSClient(&tencentcloud_cls_sdk_go.Options{
+		Host:         c.cfg.Endpoint,
+		Timeout:      int(c.cfg.Timeout.Milliseconds()),
+		CompressType: c.cfg.Compress,
+		Credentials: tencentcloud_cls_sdk_go.Credentials{
+			SecretID:    c.cfg.SecretID,
+			SecretKEY:   c.cfg.SecretKey,
+			SecretToken: c.cfg.SecurityToken,
+		},
+	})
+	if clsErr != nil {
+		return nil, fmt.Errorf("failed to create health check client: %w", clsErr)
+	}
+	if c.cfg.Proxy != "" {
+		if err := setProxy(clsClient, c.cfg.Proxy); err != nil {
+			return nil, fmt.Errorf("failed to set health check client proxy: %w", err)
+		}
+	}
+
+	return clsClient.Send(ctx, c.topicID), nil
+}
+
+// flushPollInterval is the interval Flush checks the pending logs at.
+const flushPollInterval = 50 * time.Millisecond
+
+// Flush waits until the producer has uploaded, or failed to upload, every log
+// sent to it, or until ctx is done. The producer can't be made to upload its
+// batches early, so they go out once full or after their linger time.
+func (c *Client) Flush(ctx context.Context) error {
+	ticker := c.clock.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+
+	for c.pending.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d logs are still pending: %w", c.pending.Load(), ctx.Err())
+		case <-ticker.C():
+		}
+	}
+	return nil
+}
+
+// Stats returns the counters of the logs the client handed to the producer.
+func (c *Client) Stats() ClientStats {
+	return ClientStats{
+		Pending:   c.pending.Load(),
+		Dropped:   c.dropped.Load(),
+		Failed:    c.failed.Load(),
+		Delivered: c.delivered.Load(),
+		Bytes:     c.bytes.Load(),
+	}
+}
+
+// Close stops the producer, which uploads the buffered logs at once rather
+// than after their linger time, and waits at most timeout for Tencent CLS
+// to acknowledge them. A producer shared with other clients keeps running,
+// uploading the logs as usual.
+func (c *Client) Close(timeout time.Duration) error {
+	if err := c.producer.Close(timeout.Milliseconds()); err != nil {
+		c.logger.Warn("buffered logs were dropped when closing the producer",
+			zap.Int64("dropped", c.pending.Load()),
+			zap.Duration("timeout", timeout),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
 }
 
 type clsCallback struct {
-	logger *zap.Logger
+	logger    *zap.Logger
+	pending   *atomic.Int64
+	failed    *atomic.Int64
+	delivered *atomic.Int64
 }
 
 func (callback *clsCallback) Success(result *tencentcloud_cls_sdk_go.Result) {
+	callback.pending.Add(-1)
+	callback.delivered.Add(1)
 	callback.logger.Debug("cls callback success", zap.Any("attempts", result.GetReservedAttempts()))
 }
 func (callback *clsCallback) Fail(result *tencentcloud_cls_sdk_go.Result) {
+	callback.pending.Add(-1)
+	callback.failed.Add(1)
 	callback.logger.Error("cls callback fail",
 		zap.Any("isSuccessful", result.IsSuccessful()),
 		zap.Any("errorCode", result.GetErrorCode()),
@@ -1,9 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	tencentcloud_cls_sdk_go "github.com/tencentcloud/tencentcloud-cls-sdk-go"
 	"go.uber.org/zap"
 )
 
@@ -18,12 +31,1655 @@ func TestSendMessage(t *testing.T) {
 		t.Fatalf("failed to create client: %v", err)
 	}
 
-	err = client.SendMessage(`{"a": "b"}`)
+	err = client.SendMessage(logMessage{Text: `{"a": "b"}`, Timestamp: time.Now()})
 	if err != nil {
 		t.Fatalf("failed to send message: %v", err)
 	}
 
-	if err := client.Close(); err != nil {
+	if err := client.Close(time.Second); err != nil {
 		t.Fatalf("failed to close client: %v", err)
 	}
 }
+
+type fakeProducer struct {
+	mu     sync.Mutex
+	logs   []*tencentcloud_cls_sdk_go.Log
+	topics []string
+
+	closed         bool
+	closeTimeoutMs int64
+
+	// err is returned from SendLog when set.
+	err error
+	// topicErrs are returned from SendLog for the topics they are set for.
+	topicErrs map[string]error
+	// block blocks SendLog until closed, if set, like a full producer buffer.
+	block chan struct{}
+}
+
+func (p *fakeProducer) SendLog(topicID string, log *tencentcloud_cls_sdk_go.Log, _ tencentcloud_cls_sdk_go.CallBack) error {
+	if p.block != nil {
+		<-p.block
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	if err := p.topicErrs[topicID]; err != nil {
+		return err
+	}
+	p.logs = append(p.logs, log)
+	p.topics = append(p.topics, topicID)
+	return nil
+}
+
+func (p *fakeProducer) Close(timeoutMs int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.closeTimeoutMs = timeoutMs
+	return nil
+}
+
+func (p *fakeProducer) fields(i int) map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fields := map[string]string{}
+	for _, content := range p.logs[i].GetContents() {
+		fields[content.GetKey()] = content.GetValue()
+	}
+	return fields
+}
+
+func TestSendMessageBufferDepth(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{TopicID: "topic", EmitBufferDepth: true}, p)
+
+	for i := 0; i < 3; i++ {
+		if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+	}
+	client.callback.Success(tencentcloud_cls_sdk_go.NewResult())
+	if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	for i, want := range []string{"0", "1", "2", "2"} {
+		if got := p.fields(i)["__buffer_depth__"]; got != want {
+			t.Errorf("log %d: expected buffer depth %s, got %q", i, want, got)
+		}
+	}
+}
+
+func TestClosePassesTimeout(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{CloseTimeout: 10 * time.Second}, p)
+
+	if err := client.Close(5 * time.Second); err != nil {
+		t.Fatalf("failed to close client: %v", err)
+	}
+	if !p.closed || p.closeTimeoutMs != 5000 {
+		t.Fatalf("expected producer closed with 5000ms timeout, got closed=%v timeout=%d", p.closed, p.closeTimeoutMs)
+	}
+}
+
+func TestSendMessageUsesMessageTimestamp(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{TopicID: "topic"}, p)
+
+	timestamp := time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC)
+	if err := client.SendMessage(logMessage{Text: "line", Timestamp: timestamp}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	if got := p.logs[0].GetTime(); got != timestamp.Unix() {
+		t.Fatalf("expected log time %d, got %d", timestamp.Unix(), got)
+	}
+}
+
+func TestSendMessageDefaultsTimestampToClock(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{TopicID: "topic", EmitIngestLatency: true}, p)
+	now := time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC)
+	client.clock = newFakeClock(now)
+
+	if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	if err := client.SendMessage(logMessage{Text: "line", Timestamp: now.Add(-1500 * time.Millisecond)}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	if got := p.logs[0].GetTime(); got != now.Unix() {
+		t.Fatalf("expected log time %d, got %d", now.Unix(), got)
+	}
+	if got := p.fields(1)["__ingest_latency_ms__"]; got != "1500" {
+		t.Fatalf("expected ingest latency 1500, got %q", got)
+	}
+}
+
+func TestSendMessageMillisecondTimePrecision(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{TopicID: "topic", TimePrecision: timePrecisionMillisecond}, p)
+
+	first := time.Date(2024, 6, 1, 13, 0, 0, 100*int(time.Millisecond), time.UTC)
+	second := first.Add(time.Millisecond)
+	for _, timestamp := range []time.Time{first, second} {
+		if err := client.SendMessage(logMessage{Text: "line", Timestamp: timestamp}); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+	}
+
+	if got := p.logs[0].GetTime(); got != first.UnixMilli() {
+		t.Fatalf("expected log time %d, got %d", first.UnixMilli(), got)
+	}
+	if p.logs[0].GetTime() >= p.logs[1].GetTime() {
+		t.Fatalf("expected increasing log times, got %d and %d", p.logs[0].GetTime(), p.logs[1].GetTime())
+	}
+}
+
+func TestNewProducerConfigEnqueueTimeout(t *testing.T) {
+	duration := func(d time.Duration) *time.Duration { return &d }
+
+	tests := []struct {
+		timeout *time.Duration
+		want    int
+	}{
+		{timeout: nil, want: tencentcloud_cls_sdk_go.GetDefaultAsyncProducerClientConfig().MaxBlockSec},
+		{timeout: duration(0), want: -1},
+		{timeout: duration(1500 * time.Millisecond), want: 2},
+		{timeout: duration(5 * time.Second), want: 5},
+	}
+	for _, tt := range tests {
+		got := newProducerConfig(ClientConfig{EnqueueTimeout: tt.timeout}).MaxBlockSec
+		if got != tt.want {
+			t.Errorf("timeout %v: expected MaxBlockSec %d, got %d", tt.timeout, tt.want, got)
+		}
+	}
+}
+
+func TestSendMessageEnqueueTimeout(t *testing.T) {
+	timeout := time.Second
+	cfg := ClientConfig{TopicID: "topic", EnqueueTimeout: &timeout}
+	producerConfig := newProducerConfig(cfg)
+	producerConfig.Endpoint = "127.0.0.1:1"
+	producerConfig.AccessKeyID = "id"
+	producerConfig.AccessKeySecret = "secret"
+	// The producer isn't started, so its buffer is full after the first logs.
+	producerConfig.TotalSizeLnBytes = 1
+	p, err := tencentcloud_cls_sdk_go.NewAsyncProducerClient(producerConfig)
+	if err != nil {
+		t.Fatalf("failed to create producer: %v", err)
+	}
+	client := newClient(zap.NewNop(), cfg, p)
+
+	for i := 0; i < 2; i++ {
+		if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+	}
+
+	start := time.Now()
+	if err := client.SendMessage(logMessage{Text: "line"}); err == nil {
+		t.Fatal("expected the send to a full producer to fail")
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > timeout+time.Second {
+		t.Fatalf("expected the send to fail after the %s enqueue timeout, took %s", timeout, elapsed)
+	}
+}
+
+func TestNewProducerConfigOrdering(t *testing.T) {
+	defaultWorkers := tencentcloud_cls_sdk_go.GetDefaultAsyncProducerClientConfig().MaxSendWorkerCount
+
+	tests := []struct {
+		ordering string
+		want     int64
+	}{
+		{ordering: "", want: defaultWorkers},
+		{ordering: orderingNone, want: defaultWorkers},
+		{ordering: orderingPerContainer, want: 1},
+	}
+	for _, tt := range tests {
+		got := newProducerConfig(ClientConfig{Ordering: tt.ordering}).MaxSendWorkerCount
+		if got != tt.want {
+			t.Errorf("ordering %q: expected MaxSendWorkerCount %d, got %d", tt.ordering, tt.want, got)
+		}
+	}
+}
+
+func TestSendMessageCountsDroppedLogs(t *testing.T) {
+	p := &fakeProducer{err: errors.New("over producer set maximum blocking time")}
+	client := newClient(zap.NewNop(), ClientConfig{TopicID: "topic"}, p)
+
+	if err := client.SendMessage(logMessage{Text: "line"}); err == nil {
+		t.Fatal("expected error from stalled producer")
+	}
+	if client.dropped.Load() != 1 || client.pending.Load() != 0 {
+		t.Fatalf("expected 1 dropped and 0 pending logs, got %d and %d", client.dropped.Load(), client.pending.Load())
+	}
+}
+
+func TestSendMessageOwner(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "present", labels: map[string]string{"team": "payments"}, want: "payments"},
+		{name: "absent", labels: nil, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &fakeProducer{}
+			client := newClient(zap.NewNop(), ClientConfig{
+				OwnerLabel:       "team",
+				ContainerDetails: &ContainerDetails{ContainerLabels: tt.labels},
+			}, p)
+
+			if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+				t.Fatalf("failed to send message: %v", err)
+			}
+
+			owner, ok := p.fields(0)["__owner__"]
+			if !ok || owner != tt.want {
+				t.Fatalf("expected owner %q, got %q (present=%v)", tt.want, owner, ok)
+			}
+		})
+	}
+}
+
+func TestSecurityToken(t *testing.T) {
+	cfg := ClientConfig{
+		Endpoint:      "ap-guangzhou.cls.tencentcs.com",
+		SecretID:      "id",
+		SecretKey:     "key",
+		SecurityToken: "token",
+		TopicID:       "topic",
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected valid config: %v", err)
+	}
+	if got := newProducerConfig(cfg).AccessToken; got != "token" {
+		t.Fatalf("expected security token in producer config, got %q", got)
+	}
+
+	cfg.SecretID, cfg.SecretKey = "", ""
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "security token requires") {
+		t.Fatalf("expected error for security token without secret ID and key, got %v", err)
+	}
+}
+
+func TestSendMessageIngestLatency(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{EmitIngestLatency: true}, p)
+
+	if err := client.SendMessage(logMessage{Text: "line", Timestamp: time.Now().Add(-2 * time.Second)}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	latency, err := strconv.ParseInt(p.fields(0)["__ingest_latency_ms__"], 10, 64)
+	if err != nil {
+		t.Fatalf("failed to parse latency: %v", err)
+	}
+	if latency < 2000 || latency > 60000 {
+		t.Fatalf("expected latency of about 2000ms, got %d", latency)
+	}
+}
+
+func TestSendMessageSizeBucket(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{EmitSizeBucket: true}, p)
+
+	tests := []struct {
+		size int
+		want string
+	}{
+		{0, "0-1k"},
+		{1023, "0-1k"},
+		{1024, "1k-10k"},
+		{16 << 10, "10k-100k"},
+		{512 << 10, "100k-1m"},
+		{1 << 20, "1m+"},
+	}
+	for i, tt := range tests {
+		if err := client.SendMessage(logMessage{Text: "line", Size: tt.size}); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+		if got := p.fields(i)["__size_bucket__"]; got != tt.want {
+			t.Errorf("size %d: expected bucket %q, got %q", tt.size, tt.want, got)
+		}
+	}
+}
+
+func TestSendMessageTopicLabel(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "present", labels: map[string]string{"cls.topic": "routed"}, want: "routed"},
+		{name: "empty", labels: map[string]string{"cls.topic": ""}, want: "default"},
+		{name: "absent", labels: nil, want: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &fakeProducer{}
+			client := newClient(zap.NewNop(), ClientConfig{
+				TopicID:          "default",
+				TopicLabel:       "cls.topic",
+				ContainerDetails: &ContainerDetails{ContainerLabels: tt.labels},
+			}, p)
+
+			if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+				t.Fatalf("failed to send message: %v", err)
+			}
+			if p.topics[0] != tt.want {
+				t.Fatalf("expected topic %q, got %q", tt.want, p.topics[0])
+			}
+		})
+	}
+}
+
+func TestSendMessageFanoutTopics(t *testing.T) {
+	p := &fakeProducer{topicErrs: map[string]error{"debug": errors.New("topic is full")}}
+	client := newClient(zap.NewNop(), ClientConfig{TopicID: "main", FanoutTopics: []string{"debug", "audit"}}, p)
+
+	err := client.SendMessage(logMessage{Text: "line"})
+	if err == nil || !strings.Contains(err.Error(), `topic "debug"`) {
+		t.Fatalf("expected error for the debug topic, got %v", err)
+	}
+
+	if want := []string{"main", "audit"}; !slices.Equal(p.topics, want) {
+		t.Fatalf("expected log to reach topics %v, got %v", want, p.topics)
+	}
+	if got := client.dropped.Load(); got != 1 {
+		t.Fatalf("expected 1 dropped log, got %d", got)
+	}
+	if got := client.pending.Load(); got != 2 {
+		t.Fatalf("expected 2 pending logs, got %d", got)
+	}
+}
+
+func TestSendMessageTopicIDList(t *testing.T) {
+	cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{
+		cfgTopicIDKey:      "hot,archive",
+		cfgFanoutTopicsKey: "debug",
+	}})
+	if err != nil {
+		t.Fatalf("failed to parse client config: %v", err)
+	}
+
+	p := &fakeProducer{topicErrs: map[string]error{"hot": errors.New("topic is full")}}
+	client := newClient(zap.NewNop(), cfg, p)
+
+	err = client.SendMessage(logMessage{Text: "line"})
+	if err == nil || !strings.Contains(err.Error(), `topic "hot"`) {
+		t.Fatalf("expected error for the hot topic, got %v", err)
+	}
+	if want := []string{"archive", "debug"}; !slices.Equal(p.topics, want) {
+		t.Fatalf("expected log to reach topics %v, got %v", want, p.topics)
+	}
+}
+
+func TestSendMessageDockerTruncation(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{EmitDockerTruncation: true}, p)
+
+	for _, chunks := range []int{0, 2} {
+		if err := client.SendMessage(logMessage{Text: "line", Chunks: chunks}); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+	}
+
+	if got := p.fields(0)["__docker_chunked__"]; got != "false" {
+		t.Fatalf("expected single line not to be chunked, got %q", got)
+	}
+	if got := p.fields(1)["__docker_chunked__"]; got != "true" {
+		t.Fatalf("expected reassembled line to be chunked, got %q", got)
+	}
+}
+
+func TestSendMessageRedactFields(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{RedactFields: []string{"password", "token"}}, p)
+
+	messages := []logMessage{
+		{Text: `{"user":"alice","password":"hunter2","nested":{"password":"kept"}}`},
+		{Text: "password=hunter2"},
+		{Fields: map[string]string{"token": "abc", "log": "line"}},
+	}
+	for _, msg := range messages {
+		if err := client.SendMessage(msg); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+	}
+
+	fields := p.fields(0)
+	if fields["password"] != redactedValue || fields["user"] != "alice" {
+		t.Fatalf("expected only password to be redacted, got %v", fields)
+	}
+	if text := fields["__original_text__"]; strings.Contains(text, "hunter2") || !strings.Contains(text, `"nested":{"password":"kept"}`) {
+		t.Fatalf("expected password to be redacted from the original text only at the top level, got %q", text)
+	}
+
+	if got := p.fields(1)["__original_text__"]; got != "password=hunter2" {
+		t.Fatalf("expected plain text not to be redacted, got %q", got)
+	}
+
+	if fields := p.fields(2); fields["token"] != redactedValue || fields["log"] != "line" {
+		t.Fatalf("expected only token to be redacted, got %v", fields)
+	}
+}
+
+func TestSendMessageCallerFields(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "caller", text: `{"caller":"main.go:42","file":"other.go","line":1}`, want: "main.go:42"},
+		{name: "file and line", text: `{"file":"main.go","line":42}`, want: "main.go:42"},
+		{name: "file only", text: `{"file":"main.go"}`, want: ""},
+		{name: "absent", text: `{"msg":"line"}`, want: ""},
+		{name: "plain text", text: "line", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &fakeProducer{}
+			client := newClient(zap.NewNop(), ClientConfig{CallerFields: []string{"caller", "file:line"}}, p)
+
+			if err := client.SendMessage(logMessage{Text: tt.text}); err != nil {
+				t.Fatalf("failed to send message: %v", err)
+			}
+			got, ok := p.fields(0)["__caller__"]
+			if !ok || got != tt.want {
+				t.Fatalf("expected caller %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSendMessageModeEnqueue(t *testing.T) {
+	tests := []struct {
+		mode         string
+		wantBlockSec int
+		wantMayBlock bool
+	}{
+		{mode: "", wantBlockSec: 60, wantMayBlock: true},
+		{mode: modeBlocking, wantBlockSec: -1, wantMayBlock: true},
+		{mode: modeNonBlocking, wantBlockSec: 0, wantMayBlock: false},
+	}
+	for _, tt := range tests {
+		cfg := ClientConfig{TopicID: "topic", Mode: tt.mode}
+		if got := newProducerConfig(cfg).MaxBlockSec; got != tt.wantBlockSec {
+			t.Errorf("mode %q: expected MaxBlockSec %d, got %d", tt.mode, tt.wantBlockSec, got)
+		}
+
+		// A non-blocking producer refuses the log right away when its buffer is full,
+		// which the client counts as dropped without waiting.
+		p := &fakeProducer{err: errors.New("over producer set maximum blocking time")}
+		client := newClient(zap.NewNop(), cfg, p)
+		if client.mayBlock != tt.wantMayBlock {
+			t.Errorf("mode %q: expected mayBlock %t, got %t", tt.mode, tt.wantMayBlock, client.mayBlock)
+		}
+		if err := client.SendMessage(logMessage{Text: "line"}); err == nil {
+			t.Errorf("mode %q: expected error for a full buffer", tt.mode)
+		}
+		if got := client.Stats().Dropped; got != 1 {
+			t.Errorf("mode %q: expected 1 dropped log, got %d", tt.mode, got)
+		}
+	}
+}
+
+func TestSendMessageRepeatField(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{}, p)
+
+	for _, repeat := range []int{0, 3} {
+		if err := client.SendMessage(logMessage{Text: "line", Repeat: repeat}); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+	}
+
+	if got, ok := p.fields(0)["__repeat__"]; ok {
+		t.Errorf("expected no __repeat__ field without deduplication, got %q", got)
+	}
+	if got := p.fields(1)["__repeat__"]; got != "3" {
+		t.Errorf("expected __repeat__ 3, got %q", got)
+	}
+}
+
+func TestSendMessageLogMode(t *testing.T) {
+	for _, mode := range []string{"", modeBlocking, modeNonBlocking} {
+		p := &fakeProducer{}
+		client := newClient(zap.NewNop(), ClientConfig{Mode: mode, EmitLogMode: true}, p)
+		if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+
+		want := mode
+		if want == "" {
+			want = modeBlocking
+		}
+		if got := p.fields(0)["__log_mode__"]; got != want {
+			t.Errorf("mode %q: expected __log_mode__ %q, got %q", mode, want, got)
+		}
+	}
+}
+
+func TestSendMessagePartitionField(t *testing.T) {
+	shanghai := time.FixedZone("CST", 8*60*60)
+	tests := []struct {
+		granularity string
+		timestamp   time.Time
+		want        string
+	}{
+		{granularity: partitionDay, timestamp: time.Date(2024, 6, 1, 13, 30, 0, 0, time.UTC), want: "2024-06-01"},
+		{granularity: partitionDay, timestamp: time.Date(2024, 6, 1, 23, 59, 59, 0, time.UTC), want: "2024-06-01"},
+		{granularity: partitionDay, timestamp: time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC), want: "2024-06-02"},
+		{granularity: partitionDay, timestamp: time.Date(2024, 6, 2, 7, 0, 0, 0, shanghai), want: "2024-06-01"},
+		{granularity: partitionHour, timestamp: time.Date(2024, 6, 1, 13, 59, 59, 0, time.UTC), want: "2024-06-01T13"},
+		{granularity: partitionHour, timestamp: time.Date(2024, 6, 1, 14, 0, 0, 0, time.UTC), want: "2024-06-01T14"},
+		{granularity: partitionHour, timestamp: time.Date(2024, 12, 31, 23, 0, 0, 0, time.UTC), want: "2024-12-31T23"},
+	}
+	for _, tt := range tests {
+		p := &fakeProducer{}
+		client := newClient(zap.NewNop(), ClientConfig{PartitionField: tt.granularity}, p)
+		if err := client.SendMessage(logMessage{Text: "line", Timestamp: tt.timestamp}); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+		if got := p.fields(0)["__partition__"]; got != tt.want {
+			t.Errorf("%s partition of %v: expected %q, got %q", tt.granularity, tt.timestamp, tt.want, got)
+		}
+	}
+}
+
+func TestFieldNames(t *testing.T) {
+	client := newClient(zap.NewNop(), ClientConfig{
+		InstanceInfo:               `{"zone": "a"}`,
+		AppendContainerDetailsKeys: []string{"container_name", "log_path"},
+		ContainerDetails:           &ContainerDetails{},
+		EmitBufferDepth:            true,
+	}, &fakeProducer{})
+
+	fields := client.FieldNames()
+	slices.Sort(fields)
+
+	want := []string{
+		"__buffer_depth__",
+		"__container_details__.container_log_path",
+		"__container_details__.container_name",
+		"__hostname__",
+		"__instance__.zone",
+		"__original_text__",
+	}
+	if !slices.Equal(fields, want) {
+		t.Fatalf("expected fields %v, got %v", want, fields)
+	}
+}
+
+func TestSendMessageFieldPrefix(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{
+		FieldPrefix:                "cls_",
+		InstanceInfo:               `{"zone": "a"}`,
+		AppendContainerDetailsKeys: []string{"container_name"},
+		ContainerDetails:           &ContainerDetails{ContainerName: "/app"},
+		OwnerLabel:                 "team",
+		AppendK8sPodUID:            true,
+		AppendSource:               true,
+		CallerFields:               []string{"file"},
+		EmitBufferDepth:            true,
+		EmitIngestLatency:          true,
+		PartitionField:             partitionDay,
+		EmitLogMode:                true,
+		EmitDockerTruncation:       true,
+		EmitSizeBucket:             true,
+		RedactFields:               []string{"token"},
+	}, p)
+
+	msg := logMessage{Text: `{"file":"main.go","token":"secret"}`, Source: "stdout", Level: "info", Repeat: 2, Timestamp: time.Now()}
+	if err := client.SendMessage(msg); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	fields := p.fields(0)
+	for _, name := range []string{
+		"cls_instance__.zone",
+		"cls_container_details__.container_name",
+		"cls_owner__",
+		"cls_hostname__",
+		"cls_k8s_pod_uid__",
+		"cls_source__",
+		"cls_level__",
+		"cls_repeat__",
+		"cls_caller__",
+		"cls_buffer_depth__",
+		"cls_ingest_latency_ms__",
+		"cls_partition__",
+		"cls_log_mode__",
+		"cls_docker_chunked__",
+		"cls_size_bucket__",
+		"cls_original_text__",
+	} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("expected field %s, got %v", name, fields)
+		}
+	}
+	for name := range fields {
+		if strings.HasPrefix(name, "__") {
+			t.Errorf("expected field %s to use the prefix", name)
+		}
+	}
+	if want := `{"file":"main.go","token":"******"}`; fields["cls_original_text__"] != want {
+		t.Errorf("expected the redacted original text %s, got %s", want, fields["cls_original_text__"])
+	}
+
+	if err := client.SendMessage(logMessage{Text: "plain line"}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	if got := p.fields(1)["cls_original_text__"]; got != "plain line" {
+		t.Errorf("expected the unparsed log in the prefixed raw field, got %q", got)
+	}
+}
+
+func TestContainerDetailsShortID(t *testing.T) {
+	p := &fakeProducer{}
+	fullID := "4f66d5c6b9a8e3c1a2b0f9d8c7e6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e0d9c8"
+	client := newClient(zap.NewNop(), ClientConfig{
+		AppendContainerDetailsKeys: []string{"container_id", "container_short_id"},
+		ContainerDetails:           &ContainerDetails{ContainerID: fullID},
+	}, p)
+
+	if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	fields := p.fields(0)
+	if got := fields["__container_details__.container_id"]; got != fullID {
+		t.Errorf("expected full container ID %q, got %q", fullID, got)
+	}
+	if got := fields["__container_details__.container_short_id"]; got != fullID[:12] {
+		t.Errorf("expected short container ID %q, got %q", fullID[:12], got)
+	}
+}
+
+func TestSendMessageSource(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{AppendSource: true}, p)
+
+	if err := client.SendMessage(logMessage{Text: "line", Source: "stderr"}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	if got := p.fields(0)["__source__"]; got != "stderr" {
+		t.Fatalf("expected source stderr, got %q", got)
+	}
+}
+
+func TestSendMessageContainerDetailsMode(t *testing.T) {
+	details := &ContainerDetails{
+		ContainerID:     "0123456789abcdef",
+		ContainerName:   "/app",
+		ContainerLabels: map[string]string{"team": "payments"},
+	}
+	keys := []string{"container_id", "container_name", "container_labels"}
+
+	flat := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{AppendContainerDetailsKeys: keys, ContainerDetails: details}, flat)
+	if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	nested := &fakeProducer{}
+	client = newClient(zap.NewNop(), ClientConfig{
+		AppendContainerDetailsKeys: keys,
+		ContainerDetails:           details,
+		ContainerDetailsMode:       containerDetailsModeNested,
+	}, nested)
+	if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	var nestedDetails map[string]string
+	if err := json.Unmarshal([]byte(nested.fields(0)["__container_details__"]), &nestedDetails); err != nil {
+		t.Fatalf("invalid nested container details: %v", err)
+	}
+
+	flatFields := flat.fields(0)
+	for _, k := range keys {
+		if nestedDetails[k] != flatFields["__container_details__."+k] {
+			t.Errorf("key %s: nested %q differs from flat %q", k, nestedDetails[k], flatFields["__container_details__."+k])
+		}
+		if _, ok := nested.fields(0)["__container_details__."+k]; ok {
+			t.Errorf("key %s: unexpected flat field in nested mode", k)
+		}
+	}
+}
+
+// allContainerDetailsKeys are the keys of the append_container_details_keys option.
+var allContainerDetailsKeys = []string{
+	"container_id", "container_name", "container_image_id", "container_image_name",
+	"container_created", "container_env", "container_labels", "container_entrypoint",
+	"container_args", "log_path", "daemon_name", "config",
+}
+
+func newTestContainerDetails() *ContainerDetails {
+	return &ContainerDetails{
+		ContainerID:      "0123456789abcdef",
+		ContainerName:    "/app",
+		ContainerCreated: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		ContainerEnv:     []string{"A=1", "B=2"},
+		ContainerLabels:  map[string]string{"team": "payments"},
+		ContainerArgs:    []string{"--port", "8080"},
+		Config:           map[string]string{"topic_id": "topic"},
+	}
+}
+
+func TestSendMessageCachesContainerDetails(t *testing.T) {
+	for _, mode := range []string{containerDetailsModeFlat, containerDetailsModeNested} {
+		t.Run(mode, func(t *testing.T) {
+			p := &fakeProducer{}
+			client := newClient(zap.NewNop(), ClientConfig{
+				AppendContainerDetailsKeys: allContainerDetailsKeys,
+				ContainerDetails:           newTestContainerDetails(),
+				ContainerDetailsMode:       mode,
+			}, p)
+
+			for range 2 {
+				if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+					t.Fatalf("failed to send message: %v", err)
+				}
+			}
+
+			// The cached fields are the ones marshaled for every log before.
+			want := client.containerDetailFields()
+			for i := range 2 {
+				fields := p.fields(i)
+				for k, v := range want {
+					if fields[k] != v {
+						t.Errorf("log %d: expected %s=%q, got %q", i, k, v, fields[k])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSendMessageContainerCreated(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatalf("failed to load location: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		created time.Time
+		loc     *time.Location
+		want    string
+	}{
+		{name: "utc", created: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), want: "2024-01-02T03:04:05Z"},
+		{name: "timezone", created: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), loc: shanghai, want: "2024-01-02T11:04:05+08:00"},
+		{name: "zero", created: time.Time{}, loc: shanghai, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &fakeProducer{}
+			client := newClient(zap.NewNop(), ClientConfig{
+				AppendContainerDetailsKeys: []string{"container_created"},
+				ContainerDetails:           &ContainerDetails{ContainerCreated: tt.created},
+				TimestampLocation:          tt.loc,
+			}, p)
+
+			if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+				t.Fatalf("failed to send message: %v", err)
+			}
+			if got := p.fields(0)["__container_details__.container_created"]; got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func BenchmarkLogMapContainerDetails(b *testing.B) {
+	client := newClient(zap.NewNop(), ClientConfig{
+		AppendContainerDetailsKeys: allContainerDetailsKeys,
+		ContainerDetails:           newTestContainerDetails(),
+	}, &fakeProducer{})
+	msg := logMessage{Text: "line", Timestamp: time.Now()}
+
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			client.logMap(msg)
+		}
+	})
+	b.Run("marshaled", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			client.detailFields = client.containerDetailFields()
+			client.logMap(msg)
+		}
+	})
+}
+
+func TestSendMessageK8sPodUID(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "present", labels: map[string]string{k8sPodUIDLabel: "6f1c7d0e"}, want: "6f1c7d0e"},
+		{name: "absent", labels: nil, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &fakeProducer{}
+			client := newClient(zap.NewNop(), ClientConfig{
+				AppendK8sPodUID:  true,
+				ContainerDetails: &ContainerDetails{ContainerLabels: tt.labels},
+			}, p)
+
+			if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+				t.Fatalf("failed to send message: %v", err)
+			}
+			if uid, ok := p.fields(0)["__k8s_pod_uid__"]; !ok || uid != tt.want {
+				t.Fatalf("expected pod uid %q, got %q (present=%v)", tt.want, uid, ok)
+			}
+		})
+	}
+}
+
+func TestSendMessageFields(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{}, p)
+
+	if err := client.SendMessage(logMessage{Fields: map[string]string{"log": `{"a": "b"}`}}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	fields := p.fields(0)
+	if fields["log"] != `{"a": "b"}` {
+		t.Fatalf("expected log field as is, got %q", fields["log"])
+	}
+	if _, ok := fields["a"]; ok {
+		t.Fatal("expected fields not to be parsed from JSON")
+	}
+}
+
+func TestSendMessageCtxCancelled(t *testing.T) {
+	p := &fakeProducer{block: make(chan struct{})}
+	defer close(p.block)
+	client := newClient(zap.NewNop(), ClientConfig{}, p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := client.SendMessageCtx(ctx, logMessage{Text: "line"})
+	if !errors.Is(err, errSendAbandoned) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected abandoned send error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected prompt return on cancellation, took %s", elapsed)
+	}
+}
+
+func TestSendMessageCtxBackgroundLimit(t *testing.T) {
+	p := &fakeProducer{block: make(chan struct{})}
+	defer close(p.block)
+	client := newClient(zap.NewNop(), ClientConfig{}, p)
+
+	for i := 0; i < maxBackgroundSends; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		err := client.SendMessageCtx(ctx, logMessage{Text: "line"})
+		cancel()
+		if !errors.Is(err, errSendAbandoned) {
+			t.Fatalf("expected abandoned send error, got %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	start := time.Now()
+	if err := client.SendMessageCtx(ctx, logMessage{Text: "line"}); !errors.Is(err, errTooManyBackgroundSends) {
+		t.Fatalf("expected too many background sends error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the send to fail at once, took %s", elapsed)
+	}
+}
+
+func TestSendMessageCtxWithoutCancel(t *testing.T) {
+	p := &fakeProducer{block: make(chan struct{})}
+	client := newClient(zap.NewNop(), ClientConfig{}, p)
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- client.SendMessageCtx(context.WithoutCancel(context.Background()), logMessage{Text: "line"})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if n := client.backgroundSends.Load(); n != 0 {
+		t.Fatalf("expected the send to wait for the producer in place, got %d background sends", n)
+	}
+
+	close(p.block)
+	if err := <-sent; err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+}
+
+func TestSendMessageCtxDone(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{}, p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := client.SendMessageCtx(ctx, logMessage{Text: "line"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled error, got %v", err)
+	}
+	if len(p.logs) != 0 {
+		t.Fatal("expected no log to be sent")
+	}
+}
+
+func TestSendMessageLevel(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{}, p)
+
+	for _, level := range []string{"WARN", ""} {
+		if err := client.SendMessage(logMessage{Text: "line", Level: level}); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+	}
+
+	if got := p.fields(0)["__level__"]; got != "WARN" {
+		t.Errorf("expected __level__ WARN, got %q", got)
+	}
+	if _, ok := p.fields(1)["__level__"]; ok {
+		t.Error("expected no __level__ field without a level")
+	}
+}
+
+func TestSendMessageStaticFields(t *testing.T) {
+	cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{
+		cfgStaticFieldsKey: "env=prod,cluster=cn-1,__hostname__=spoofed",
+	}})
+	if err != nil {
+		t.Fatalf("failed to parse client config: %v", err)
+	}
+
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), cfg, p)
+	if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	fields := p.fields(0)
+	if fields["env"] != "prod" || fields["cluster"] != "cn-1" {
+		t.Fatalf("expected static fields, got %v", fields)
+	}
+	if fields["__hostname__"] == "spoofed" {
+		t.Fatal("expected reserved static field to be skipped")
+	}
+}
+
+func TestSendMessageStaticFieldsFieldPrefix(t *testing.T) {
+	cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{
+		cfgFieldPrefixKey:  "cls_",
+		cfgStaticFieldsKey: "env=prod,cls_hostname__=spoofed,__TAG__=spoofed",
+	}})
+	if err != nil {
+		t.Fatalf("failed to parse client config: %v", err)
+	}
+	if want := map[string]string{"env": "prod"}; !maps.Equal(cfg.StaticFields, want) {
+		t.Fatalf("expected static fields %v, got %v", want, cfg.StaticFields)
+	}
+
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), cfg, p)
+	if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	if p.fields(0)["cls_hostname__"] == "spoofed" {
+		t.Fatal("expected the static field with the prefixed reserved name to be skipped")
+	}
+}
+
+func TestParseClientConfigStaticFieldsInvalid(t *testing.T) {
+	_, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{
+		cfgStaticFieldsKey: "env=prod,cluster",
+	}})
+	if err == nil || !strings.Contains(err.Error(), cfgStaticFieldsKey) {
+		t.Fatalf("expected error for the pair without a value, got %v", err)
+	}
+}
+
+func TestSendMessageRawFieldName(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{RawFieldName: "message"}, p)
+
+	if err := client.SendMessage(logMessage{Text: "plain line"}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	fields := p.fields(0)
+	if fields["message"] != "plain line" {
+		t.Fatalf("expected plain line in the message field, got %q", fields["message"])
+	}
+	if _, ok := fields["__original_text__"]; ok {
+		t.Fatal("expected no __original_text__ field")
+	}
+}
+
+func TestSendMessageMaxFields(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{MaxFields: 3}, p)
+
+	text := `{"a":"1","b":"2","c":"3","d":"4","e":"5"}`
+	if err := client.SendMessage(logMessage{Text: text}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	fields := p.fields(0)
+	for _, k := range []string{"a", "b"} {
+		if _, ok := fields[k]; !ok {
+			t.Errorf("expected field %q to be kept", k)
+		}
+	}
+	for _, k := range []string{"c", "d", "e"} {
+		if _, ok := fields[k]; ok {
+			t.Errorf("expected field %q to overflow", k)
+		}
+	}
+	if want := `{"c":"3","d":"4","e":"5"}`; fields["__overflow__"] != want {
+		t.Fatalf("expected overflow %s, got %s", want, fields["__overflow__"])
+	}
+	if fields["__original_text__"] != text {
+		t.Fatal("expected original text to be kept")
+	}
+}
+
+func TestSendMessageMaxFieldsNotExceeded(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{MaxFields: 2}, p)
+
+	if err := client.SendMessage(logMessage{Text: `{"a":"1","b":"2"}`}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	if _, ok := p.fields(0)["__overflow__"]; ok {
+		t.Fatal("expected no overflow field")
+	}
+}
+
+func TestSendMessageIncludeRaw(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{
+		IncludeRaw:   true,
+		RawFieldName: "message",
+		RedactFields: []string{"token"},
+		MaxFields:    2,
+	}, p)
+
+	if err := client.SendMessage(logMessage{Text: `{"level":"info","token":"secret"}`}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	if err := client.SendMessage(logMessage{Text: "plain line"}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	fields := p.fields(0)
+	if fields["level"] != "info" || fields["token"] != redactedValue {
+		t.Fatalf("expected the parsed fields, got %v", fields)
+	}
+	if want := `{"level":"info","token":"******"}`; fields["message"] != want {
+		t.Fatalf("expected the redacted log in the raw field, got %q", fields["message"])
+	}
+	if _, ok := fields["__original_text__"]; ok {
+		t.Fatal("expected the log to be moved to the raw field")
+	}
+	// The raw field doesn't count toward the maximum number of fields.
+	if _, ok := fields["__overflow__"]; ok {
+		t.Fatalf("expected no overflow field, got %v", fields)
+	}
+
+	if got := p.fields(1)["message"]; got != "plain line" {
+		t.Fatalf("expected the unparsed log in the raw field, got %q", got)
+	}
+}
+
+func TestSendMessageIncludeRawDefaultField(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{IncludeRaw: true}, p)
+
+	text := `{"level":"info"}`
+	if err := client.SendMessage(logMessage{Text: text}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	fields := p.fields(0)
+	delete(fields, "__hostname__")
+	if want := map[string]string{"level": "info", "__original_text__": text}; !maps.Equal(fields, want) {
+		t.Fatalf("expected fields %v, got %v", want, fields)
+	}
+}
+
+func TestSendMessageIncludeRawCollision(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{IncludeRaw: true, RawFieldName: "message"}, p)
+
+	text := `{"level":"info","message":"user logged in"}`
+	if err := client.SendMessage(logMessage{Text: text}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	fields := p.fields(0)
+	if fields["message"] != "user logged in" {
+		t.Fatalf("expected the parsed message field to be kept, got %q", fields["message"])
+	}
+	if fields["__original_text__"] != text {
+		t.Fatalf("expected the log to be kept in the original text field, got %q", fields["__original_text__"])
+	}
+}
+
+func TestSendMessageWithoutIncludeRaw(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{RawFieldName: "message"}, p)
+
+	if err := client.SendMessage(logMessage{Text: `{"level":"info"}`}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	if _, ok := p.fields(0)["message"]; ok {
+		t.Fatal("expected the parsed log not to be sent in the raw field")
+	}
+}
+
+func TestSendMessageHostname(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("failed to get hostname: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		cfg    ClientConfig
+		want   string
+		wantOK bool
+	}{
+		{name: "enabled", cfg: ClientConfig{}, want: hostname, wantOK: true},
+		{name: "disabled", cfg: ClientConfig{OmitHostname: true}},
+		{name: "override", cfg: ClientConfig{Hostname: "node-1"}, want: "node-1", wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &fakeProducer{}
+			client := newClient(zap.NewNop(), tt.cfg, p)
+
+			if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+				t.Fatalf("failed to send message: %v", err)
+			}
+			got, ok := p.fields(0)["__hostname__"]
+			if ok != tt.wantOK || got != tt.want {
+				t.Fatalf("expected __hostname__ %q (present: %t), got %q (present: %t)", tt.want, tt.wantOK, got, ok)
+			}
+		})
+	}
+}
+
+func TestSendMessageFlattenJSON(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{FlattenJSON: true}, p)
+
+	text := `{"http":{"status":200,"ok":true,"latency":0.25},"tags":["a",{"b":null}],"msg":"done"}`
+	if err := client.SendMessage(logMessage{Text: text}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	fields := p.fields(0)
+	want := map[string]string{
+		"http.status":  "200",
+		"http.ok":      "true",
+		"http.latency": "0.25",
+		"tags.0":       "a",
+		"tags.1.b":     "",
+		"msg":          "done",
+	}
+	for k, v := range want {
+		if got, ok := fields[k]; !ok || got != v {
+			t.Errorf("expected %s=%q, got %q", k, v, got)
+		}
+	}
+	if _, ok := fields["http"]; ok {
+		t.Error("expected nested object not to be sent as a field")
+	}
+}
+
+func TestSendMessageFlattenJSONMaxDepth(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{FlattenJSON: true}, p)
+
+	text := `{"a":` + strings.Repeat(`{"a":`, maxFlattenDepth) + `1` + strings.Repeat(`}`, maxFlattenDepth) + `}`
+	if err := client.SendMessage(logMessage{Text: text}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	path := "a" + strings.Repeat(".a", maxFlattenDepth-1)
+	want := `{"a":1}`
+	if got := p.fields(0)[path]; got != want {
+		t.Fatalf("expected %s=%q, got %q", path, want, got)
+	}
+}
+
+func TestSendMessageWithoutFlattenJSON(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{}, p)
+
+	if err := client.SendMessage(logMessage{Text: `{"http":{"status":200}}`}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	fields := p.fields(0)
+	if _, ok := fields["http.status"]; ok {
+		t.Fatal("expected nested object not to be flattened")
+	}
+	if fields["http"] == "" {
+		t.Fatal("expected nested object as a field")
+	}
+}
+
+func TestParseLogfmt(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want map[string]string
+	}{
+		{
+			name: "plain values",
+			text: "level=info status=200 path=/login",
+			want: map[string]string{"level": "info", "status": "200", "path": "/login"},
+		},
+		{
+			name: "quoted values",
+			text: `level=warn msg="user logged in" user=""`,
+			want: map[string]string{"level": "warn", "msg": "user logged in", "user": ""},
+		},
+		{
+			name: "escaped characters",
+			text: `msg="say \"hi\"\tnow" path="C:\\logs"`,
+			want: map[string]string{"msg": "say \"hi\"\tnow", "path": `C:\logs`},
+		},
+		{
+			name: "empty value and extra spaces",
+			text: "  a= \tb=2  ",
+			want: map[string]string{"a": "", "b": "2"},
+		},
+		{name: "plain text", text: "user logged in"},
+		{name: "key without value", text: "level=info done"},
+		{name: "missing key", text: "=info"},
+		{name: "unterminated quote", text: `msg="user logged in`},
+		{name: "text after quote", text: `msg="user"x level=info`},
+		{name: "quote in value", text: `msg=a"b`},
+		{name: "empty", text: "   "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseLogfmt(tt.text)
+			if ok != (tt.want != nil) {
+				t.Fatalf("expected ok %v, got %v (%v)", tt.want != nil, ok, got)
+			}
+			if tt.want != nil && !maps.Equal(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSendMessageParseFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		text   string
+		want   map[string]string
+	}{
+		{
+			format: parseFormatLogfmt,
+			text:   `level=info msg="user logged in"`,
+			want:   map[string]string{"level": "info", "msg": "user logged in", "__original_text__": `level=info msg="user logged in"`},
+		},
+		{
+			format: parseFormatLogfmt,
+			text:   "user logged in",
+			want:   map[string]string{"__original_text__": "user logged in"},
+		},
+		{
+			format: parseFormatLogfmt,
+			text:   `{"level":"info"}`,
+			want:   map[string]string{"__original_text__": `{"level":"info"}`},
+		},
+		{
+			format: parseFormatNone,
+			text:   `{"level":"info"}`,
+			want:   map[string]string{"__original_text__": `{"level":"info"}`},
+		},
+		{
+			format: "",
+			text:   `{"level":"info"}`,
+			want:   map[string]string{"level": "info", "__original_text__": `{"level":"info"}`},
+		},
+		{
+			format: parseFormatJSON,
+			text:   "level=info",
+			want:   map[string]string{"__original_text__": "level=info"},
+		},
+	}
+	for _, tt := range tests {
+		p := &fakeProducer{}
+		client := newClient(zap.NewNop(), ClientConfig{ParseFormat: tt.format}, p)
+
+		if err := client.SendMessage(logMessage{Text: tt.text}); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+
+		got := p.fields(0)
+		delete(got, "__hostname__")
+		if !maps.Equal(got, tt.want) {
+			t.Errorf("format %q, text %q: expected fields %v, got %v", tt.format, tt.text, tt.want, got)
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{name: "healthy", status: http.StatusOK},
+		{name: "empty upload refused", status: http.StatusBadRequest},
+		{
+			name:    "forbidden",
+			status:  http.StatusForbidden,
+			body:    `{"errorcode":"SignatureFailure","errormessage":"signature mismatch"}`,
+			wantErr: `credentials or topic "topic" rejected: SignatureFailure: signature mismatch`,
+		},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: "endpoint failed with status 500"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var topic string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				topic = r.URL.Query().Get("topic_id")
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			client := newClient(zap.NewNop(), ClientConfig{
+				Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+				SecretID:  "id",
+				SecretKey: "key",
+				TopicID:   "topic",
+				Timeout:   time.Second,
+			}, &fakeProducer{})
+
+			err := client.HealthCheck(context.Background())
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("expected healthy, got %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+			}
+			if topic != "topic" {
+				t.Fatalf("expected health check of topic %q, got %q", "topic", topic)
+			}
+		})
+	}
+}
+
+func TestHealthCheckUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	endpoint := strings.TrimPrefix(server.URL, "http://")
+	server.Close()
+
+	client := newClient(zap.NewNop(), ClientConfig{
+		Endpoint:  endpoint,
+		SecretID:  "id",
+		SecretKey: "key",
+		TopicID:   "topic",
+		Timeout:   time.Second,
+	}, &fakeProducer{})
+
+	if err := client.HealthCheck(context.Background()); err == nil || !strings.Contains(err.Error(), "failed to reach endpoint") {
+		t.Fatalf("expected unreachable error, got %v", err)
+	}
+}
+
+func TestNewClientVerifyCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{name: "server error", status: http.StatusInternalServerError},
+		{
+			name:    "unauthorized",
+			status:  http.StatusUnauthorized,
+			body:    `{"errorcode":"AuthFailure","errormessage":"secret id not found"}`,
+			wantErr: "credentials rejected: AuthFailure: secret id not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			client, err := NewClient(zap.NewNop(), ClientConfig{
+				Endpoint:          strings.TrimPrefix(server.URL, "http://"),
+				SecretID:          "id",
+				SecretKey:         "key",
+				TopicID:           "topic",
+				Timeout:           time.Second,
+				VerifyCredentials: true,
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to create client: %v", err)
+			}
+			_ = client.Close(time.Second)
+		})
+	}
+}
+
+func TestNewClientProxy(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		hosts []string
+	)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		hosts = append(hosts, r.URL.Host)
+	}))
+	defer proxy.Close()
+
+	client, err := NewClient(zap.NewNop(), ClientConfig{
+		Endpoint:          "cls.invalid",
+		Proxy:             proxy.URL,
+		SecretID:          "id",
+		SecretKey:         "key",
+		TopicID:           "topic",
+		Timeout:           time.Second,
+		VerifyCredentials: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer client.Close(time.Second)
+
+	if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Flush(ctx); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The credentials check and the upload of the log both go through the proxy.
+	if want := []string{"cls.invalid", "cls.invalid"}; !slices.Equal(hosts, want) {
+		t.Fatalf("expected proxied requests to %v, got %v", want, hosts)
+	}
+}
+
+func TestFlushWaitsForPendingLogs(t *testing.T) {
+	p := &fakeProducer{}
+	client := newClient(zap.NewNop(), ClientConfig{}, p)
+
+	for range 2 {
+		if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+	}
+
+	var acked atomic.Bool
+	time.AfterFunc(100*time.Millisecond, func() {
+		acked.Store(true)
+		client.callback.Success(tencentcloud_cls_sdk_go.NewResult())
+		client.callback.Fail(tencentcloud_cls_sdk_go.NewResult())
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.Flush(ctx); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if !acked.Load() {
+		t.Fatal("expected Flush to wait for the pending logs")
+	}
+}
+
+func TestFlushTicksWithClock(t *testing.T) {
+	client := newClient(zap.NewNop(), ClientConfig{}, &fakeProducer{})
+	clock := newFakeClock(time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC))
+	client.clock = clock
+	if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- client.Flush(context.Background())
+	}()
+	<-clock.created
+
+	clock.Advance(flushPollInterval)
+	select {
+	case err := <-flushed:
+		t.Fatalf("expected Flush to wait for the pending log, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The acknowledged log is seen at the next tick.
+	client.callback.Success(tencentcloud_cls_sdk_go.NewResult())
+	clock.Advance(flushPollInterval)
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Fatalf("failed to flush: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Flush to return at the tick")
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	client := newClient(zap.NewNop(), ClientConfig{}, &fakeProducer{})
+	if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := client.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded error, got %v", err)
+	}
+}
+
+func TestCallbackCountsFailedLogs(t *testing.T) {
+	client := newClient(zap.NewNop(), ClientConfig{}, &fakeProducer{})
+	client.pending.Store(2)
+
+	client.callback.Fail(&tencentcloud_cls_sdk_go.Result{})
+	client.callback.Success(&tencentcloud_cls_sdk_go.Result{})
+
+	if got := client.Stats().Failed; got != 1 {
+		t.Fatalf("expected 1 failed log, got %d", got)
+	}
+	if got := client.pending.Load(); got != 0 {
+		t.Fatalf("expected no pending logs, got %d", got)
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	client := newClient(zap.NewNop(), ClientConfig{}, &fakeProducer{})
+	for range 4 {
+		if err := client.SendMessage(logMessage{Text: "line"}); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+	}
+
+	client.callback.Success(&tencentcloud_cls_sdk_go.Result{})
+	client.callback.Success(&tencentcloud_cls_sdk_go.Result{})
+	client.callback.Fail(&tencentcloud_cls_sdk_go.Result{})
+
+	got := client.Stats()
+	if got.Bytes <= 0 {
+		t.Fatalf("expected the sent bytes to be counted, got %d", got.Bytes)
+	}
+	got.Bytes = 0
+	if want := (ClientStats{Pending: 1, Failed: 1, Delivered: 2}); got != want {
+		t.Fatalf("expected stats %+v, got %+v", want, got)
+	}
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		valid    bool
+	}{
+		{endpoint: "ap-guangzhou.cls.tencentcs.com", valid: true},
+		{endpoint: "ap-guangzhou.cls.tencentyun.com:80", valid: true},
+		{endpoint: "10.0.0.1:8080", valid: true},
+		{endpoint: "[::1]:80", valid: true},
+		{endpoint: "https://ap-guangzhou.cls.tencentcs.com"},
+		{endpoint: "ap-guangzhou.cls.tencentcs.com/structuredlog"},
+		{endpoint: "ap-guangzhou.cls.tencentcs.com:http"},
+		{endpoint: "user@ap-guangzhou.cls.tencentcs.com"},
+		{endpoint: "ap guangzhou"},
+		{endpoint: ":80"},
+	}
+	for _, tt := range tests {
+		err := validateEndpoint(tt.endpoint)
+		if tt.valid && err != nil {
+			t.Errorf("endpoint %q: expected valid, got %v", tt.endpoint, err)
+		}
+		if !tt.valid && (err == nil || !strings.Contains(err.Error(), tt.endpoint)) {
+			t.Errorf("endpoint %q: expected error naming the endpoint, got %v", tt.endpoint, err)
+		}
+	}
+}
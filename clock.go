@@ -0,0 +1,40 @@
+package main
+
+import "time"
+
+// clock tells the time and creates tickers and timers, so tests can drive the time.
+type clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) ticker
+	// After returns a channel receiving the time once d elapsed, like time.After.
+	After(d time.Duration) <-chan time.Time
+}
+
+// ticker delivers the ticks of a clock like time.Ticker.
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock is a clock whose time only moves when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	// created receives a value for every ticker or timer created.
+	created chan struct{}
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, created: make(chan struct{}, 16)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	c.created <- struct{}{}
+	return t
+}
+
+// After returns the channel of a ticker without period, which ticks once.
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	c.created <- struct{}{}
+	return t.c
+}
+
+// Advance moves the time forward, ticking the tickers due meanwhile.
+// Like time.Ticker, a tick is dropped if the previous one wasn't received.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		if t.stopped || t.next.After(c.now) {
+			continue
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+		if t.period == 0 {
+			t.stopped = true
+			continue
+		}
+		for !t.next.After(c.now) {
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock   *fakeClock
+	c       chan time.Time
+	period  time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
@@ -63,7 +63,7 @@ func NewDriver(zapLogger *zap.Logger) *Driver {
 }
 
 func (d *Driver) StartLogging(streamPath string, containerDetails *ContainerDetails) (stream *logStream, err error) {
-	d.logger.Info("starting logging", zap.String("stream_path", streamPath), zap.Any("container_details", containerDetails))
+	d.logger.Info("starting logging", zap.String("stream_path", streamPath), zap.Any("container_details", redactContainerDetails(containerDetails)))
 
 	d.mu.RLock()
 	if _, ok := d.streams[streamPath]; ok {
@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"github.com/docker/docker/api/types/backend"
 	"github.com/docker/docker/daemon/logger"
 	"github.com/valyala/fasttemplate"
 	"go.uber.org/zap"
@@ -15,22 +26,104 @@ import (
 const (
 	// driverName is the name of the driver.
 	driverName = "tencent-cls"
+
+	// k8sPodUIDLabel is the container label set by Kubernetes to the pod UID.
+	k8sPodUIDLabel = "io.kubernetes.pod.uid"
+
+	// labelTagPrefix and envTagPrefix prefix the template tags
+	// referencing a container label or env var, e.g. {env.APP_VERSION}.
+	labelTagPrefix = "label."
+	envTagPrefix   = "env."
+
+	// tagModifierSeparator separates a template tag from its modifiers,
+	// e.g. {log:truncate:512}.
+	tagModifierSeparator = ":"
 )
 
 var (
-	errUnknownTag   = errors.New("unknown tag")
-	errLoggerClosed = errors.New("logger is closed")
+	errUnknownTag         = errors.New("unknown tag")
+	errUnknownTagModifier = errors.New("unknown tag modifier")
+	errLoggerClosed       = errors.New("logger is closed")
 )
 
 // client is an interface that represents a Tencent CLS client.
 type client interface {
-	SendMessage(message string) error
-	Close() error
+	SendMessage(message logMessage) error
+	// SendMessageCtx is SendMessage returning early once ctx is done,
+	// with errSendAbandoned if the log may still be sent.
+	SendMessageCtx(ctx context.Context, message logMessage) error
+	// FieldNames returns the names of the fields the client adds to every log.
+	FieldNames() []string
+	// Stats returns the counters of the logs handed to the client.
+	Stats() ClientStats
+	// HealthCheck returns an error when the client can't upload logs.
+	HealthCheck(ctx context.Context) error
+	// Flush waits for the logs sent so far to be uploaded.
+	Flush(ctx context.Context) error
+	// Close uploads the buffered logs at once and waits at most timeout
+	// for Tencent CLS to acknowledge them.
+	Close(timeout time.Duration) error
+}
+
+// LoggerStats are the counters of the logs a TencentCLSLogger delivered or lost.
+type LoggerStats struct {
+	// Dropped is the number of logs the client refused to send,
+	// e.g. when the producer buffer is full.
+	Dropped int64
+	// Abandoned is the number of logs whose send was given up while the
+	// producer buffer was full, past the send deadline or on close.
+	// The producer may still upload them once it has room.
+	Abandoned int64
+	// Failed is the number of logs which failed to be uploaded
+	// after exhausting the retries.
+	Failed int64
+	// Delivered is the number of logs uploaded to Tencent CLS.
+	Delivered int64
+	// Received is the number of logs received from the container.
+	Received int64
+	// Bytes is the size in bytes of the logs handed to the producer.
+	Bytes int64
+	// Pending is the number of logs queued in the producer
+	// and not yet acknowledged by Tencent CLS.
+	Pending int64
+	// Sampled is the number of logs dropped by the sampling.
+	Sampled int64
+}
+
+// logMessage is a formatted log message to be sent by the client.
+type logMessage struct {
+	// Text is the formatted log line.
+	Text string
+	// Timestamp is the time the log was produced by the container.
+	Timestamp time.Time
+	// Source is the stream the log was written to, "stdout" or "stderr".
+	Source string
+	// Size is the length in bytes of the raw log line.
+	Size int
+	// Chunks is the number of partial messages Docker split the log into,
+	// or zero if the log wasn't split.
+	Chunks int
+	// Level is the level extracted from the log line, empty if none.
+	Level string
+	// Repeat is the number of identical consecutive logs collapsed
+	// into this one, or zero if the deduplication is disabled.
+	Repeat int
+	// Fields are the formatted fields of the log in the json format.
+	// When set, they are sent as is instead of being parsed from Text.
+	Fields map[string]string
 }
 
 // TencentCLSLoggerOption is a function that configures a TencentCLSLogger.
 type TencentCLSLoggerOption func(*TencentCLSLogger)
 
+// WithClient makes the logger send the logs with the client
+// instead of creating a Tencent CLS client from the options.
+func WithClient(client client) TencentCLSLoggerOption {
+	return func(l *TencentCLSLogger) {
+		l.client = client
+	}
+}
+
 // TencentCLSLogger is a logger that sends logs to Tencent CLS.
 // It implements the logger.Logger interface.
 type TencentCLSLogger struct {
@@ -40,9 +133,47 @@ type TencentCLSLogger struct {
 	cfg       *loggerConfig
 
 	mu sync.Mutex
+	// inflight is held for reading by the Log calls in progress,
+	// which Close waits for before closing the client.
+	inflight sync.RWMutex
 
 	partialLogsBuffer *partialLogBuffer
 
+	// dropped is the number of logs the client refused to send.
+	dropped atomic.Int64
+	// abandoned is the number of logs whose send was given up.
+	abandoned atomic.Int64
+	// received is the number of logs received from the container.
+	received atomic.Int64
+	// receivedBytes is the size in bytes of the logs received from the container.
+	receivedBytes atomic.Int64
+	// sampled is the number of logs dropped by the sampling.
+	sampled atomic.Int64
+	// sample returns a pseudo-random number in [0, 1) deciding if a log is sampled.
+	sample func() float64
+
+	clock clock
+
+	dedupMu sync.Mutex
+	// dedup is the log held by the deduplication, nil if none.
+	dedup *dedupLog
+
+	// unregisterMetrics stops exporting the counters, nil if metrics-addr isn't set.
+	unregisterMetrics func()
+
+	// spool holds the logs the client refused to send, nil if disabled.
+	spool *spool
+
+	// sendQueue holds the logs waiting for the send workers,
+	// nil if the logs are sent by Log itself.
+	sendQueue chan logMessage
+	senders   sync.WaitGroup
+
+	// sendCtx is cancelled on Close to abort the sends blocked on the client.
+	sendCtx     context.Context
+	cancelSends context.CancelFunc
+
+	wg     sync.WaitGroup
 	closed chan struct{}
 	logger *zap.Logger
 }
@@ -55,29 +186,28 @@ func NewTencentCLSLogger(
 	containerDetails *ContainerDetails,
 	opts ...TencentCLSLoggerOption,
 ) (*TencentCLSLogger, error) {
-	cfg, err := parseLoggerConfig(containerDetails)
+	cfg, err := parseLoggerConfig(logger, containerDetails)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse logger config: %w", err)
 	}
 
-	logger.Debug("parsed logger config", zap.Any("config", cfg))
-	logger.Debug("parsed container details", zap.Any("details", containerDetails))
+	logger.Debug("parsed logger config", zap.Any("config", cfg.redacted()))
+	logger.Debug("parsed container details", zap.Any("details", redactContainerDetails(containerDetails)))
 
-	formatter, err := newMessageFormatter(containerDetails, cfg.Attrs, cfg.Template)
+	formatter, err := newMessageFormatter(containerDetails, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create message formatter: %w", err)
 	}
 
-	client, err := NewClient(logger, cfg.ClientConfig)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Tencent CLS Client: %w", err)
-	}
-
+	sendCtx, cancelSends := context.WithCancel(context.Background())
 	l := &TencentCLSLogger{
-		client:            client,
+		sendCtx:           sendCtx,
+		cancelSends:       cancelSends,
 		formatter:         formatter,
 		cfg:               cfg,
-		partialLogsBuffer: newPartialLogBuffer(),
+		partialLogsBuffer: newPartialLogBuffer(int(cfg.PartialLogInitialSize), int(cfg.PartialLogMaxSize)),
+		sample:            rand.Float64,
+		clock:             realClock{},
 		closed:            make(chan struct{}),
 		logger:            logger,
 	}
@@ -86,46 +216,540 @@ func NewTencentCLSLogger(
 		opt(l)
 	}
 
+	if l.client == nil {
+		l.client, err = NewClient(logger, cfg.ClientConfig)
+		if err != nil {
+			cancelSends()
+			return nil, fmt.Errorf("failed to create Tencent CLS Client: %w", err)
+		}
+	}
+
+	if cfg.HealthcheckOnStart {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ClientConfig.Timeout)
+		err := l.HealthCheck(ctx)
+		cancel()
+		if err != nil {
+			cancelSends()
+			_ = l.client.Close(cfg.ClientConfig.CloseTimeout)
+			return nil, fmt.Errorf("health check failed: %w", err)
+		}
+	}
+
+	if cfg.MetricsAddr != "" {
+		l.unregisterMetrics, err = metricsServers.Register(logger, cfg.MetricsAddr, l)
+		if err != nil {
+			cancelSends()
+			_ = l.client.Close(cfg.ClientConfig.CloseTimeout)
+			return nil, fmt.Errorf("failed to start metrics server: %w", err)
+		}
+	}
+
+	if cfg.SpoolDir != "" {
+		l.spool, err = newSpool(logger, cfg.SpoolDir, cfg.SpoolMaxSize)
+		if err != nil {
+			cancelSends()
+			_ = l.client.Close(cfg.ClientConfig.CloseTimeout)
+			if l.unregisterMetrics != nil {
+				l.unregisterMetrics()
+			}
+			return nil, fmt.Errorf("failed to open spool: %w", err)
+		}
+		l.wg.Add(1)
+		go l.runSpoolReplayer()
+	}
+
+	if cfg.SendConcurrency > 1 {
+		l.startSenders(cfg.SendConcurrency)
+	}
+
+	if cfg.PartialLogTimeout > 0 {
+		l.wg.Add(1)
+		go l.runPartialLogSweeper()
+	}
+	if cfg.DedupWindow > 0 {
+		l.wg.Add(1)
+		go l.runDedupFlusher()
+	}
+	if cfg.SchemaDescriptorInterval > 0 {
+		l.wg.Add(1)
+		go l.runSchemaDescriptor()
+	}
+	if cfg.StatsInterval > 0 {
+		l.wg.Add(1)
+		go l.runStatsReporter()
+	}
+	if cfg.ThroughputInterval > 0 {
+		l.wg.Add(1)
+		go l.runThroughputReporter()
+	}
+
 	return l, nil
 }
 
+// HealthCheck checks the logger can upload logs to Tencent CLS.
+func (l *TencentCLSLogger) HealthCheck(ctx context.Context) error {
+	return l.client.HealthCheck(ctx)
+}
+
+// Flush waits for the logs logged so far to be uploaded, or until ctx is done.
+// It may be called concurrently with Log, in which case it also waits for the
+// logs logged meanwhile.
+func (l *TencentCLSLogger) Flush(ctx context.Context) error {
+	return l.client.Flush(ctx)
+}
+
 // Name implements the logger.Logger interface.
 func (l *TencentCLSLogger) Name() string {
 	return driverName
 }
 
 // Log implements the logger.Logger interface.
+//
+// Log may be called concurrently with Close. Once Close is called, Log returns
+// errLoggerClosed, and the client is closed only after the Log calls already
+// in progress return, so no log is sent to a closed client.
 func (l *TencentCLSLogger) Log(log *logger.Message) error {
+	l.inflight.RLock()
+	defer l.inflight.RUnlock()
+
 	if l.isClosed() {
 		return errLoggerClosed
 	}
+	l.received.Add(1)
+	l.receivedBytes.Add(int64(len(log.Line)))
+	if l.cfg.Disabled {
+		return nil
+	}
 
 	if log.PLogMetaData != nil {
-		assembledLog, last := l.partialLogsBuffer.Append(log)
+		assembledLog, last := l.partialLogsBuffer.Append(log, l.clock.Now())
 		if !last {
 			return nil
 		}
+		if !assembledLog.PLogMetaData.Last {
+			l.logger.Warn("flushing partial log exceeding the maximum size",
+				zap.Int("size", len(assembledLog.Line)), zap.Int64("maxSize", l.cfg.PartialLogMaxSize))
+		}
 
+		// The caller logs the message to the local log file too, where the
+		// assembled log is a whole line, so only the chunk count is kept.
+		chunks := assembledLog.PLogMetaData.Ordinal
 		*log = *assembledLog
-	}
-
-	if l.cfg.FilterRegex != nil && !l.cfg.FilterRegex.Match(log.Line) {
-		l.logger.Debug("message is filtered out by regex", zap.String("regex", l.cfg.FilterRegex.String()))
+		log.PLogMetaData = nil
+		l.log(log, chunks)
 		return nil
 	}
 
-	text := l.formatter.Format(log)
-	l.send(text)
+	l.log(log, 0)
 	return nil
 }
 
-func (l *TencentCLSLogger) send(log string) {
-	if err := l.client.SendMessage(log); err != nil {
-		l.logger.Error("failed to send log message", zap.Error(err))
+// log filters, formats and sends a complete log message
+// assembled from the given number of chunks, zero if it wasn't split.
+func (l *TencentCLSLogger) log(log *logger.Message, chunks int) {
+	switch l.cfg.InvalidUTF8 {
+	case invalidUTF8Replace:
+		if !utf8.Valid(log.Line) {
+			// The caller logs the message to the local log file too,
+			// where the line is kept as is.
+			sanitized := *log
+			sanitized.Line = bytes.ToValidUTF8(log.Line, []byte(string(utf8.RuneError)))
+			log = &sanitized
+		}
+	case invalidUTF8Drop:
+		if !utf8.Valid(log.Line) {
+			l.logger.Debug("message is dropped as invalid UTF-8", zap.Int("size", len(log.Line)))
+			return
+		}
+	}
+	if len(l.cfg.FilterRegexes) > 0 && l.matchFilter(log.Line) == (l.cfg.FilterMode == filterModeExclude) {
+		l.logger.Debug("message is filtered out by regex", zap.String("mode", l.cfg.FilterMode), zap.String("combine", l.cfg.FilterCombine))
+		return
+	}
+	if !l.keepSample(log.Line) {
+		l.sampled.Add(1)
+		return
+	}
+	if l.cfg.DedupWindow > 0 && l.repeatDedup(log, l.clock.Now()) {
+		return
+	}
+
+	msg := logMessage{
+		Timestamp: log.Timestamp,
+		Source:    log.Source,
+		Size:      len(log.Line),
+		Chunks:    chunks,
+	}
+	if l.cfg.LevelRegex != nil {
+		if match := l.cfg.LevelRegex.FindSubmatch(log.Line); match != nil {
+			msg.Level = string(match[1])
+		}
+	}
+	if l.cfg.Format == formatJSON {
+		msg.Fields = l.formatter.FormatFields(log)
+	} else {
+		msg.Text = l.formatter.Format(log)
+	}
+	if l.cfg.DedupWindow > 0 {
+		l.holdDedup(log, msg, l.clock.Now())
+		return
+	}
+	l.send(msg)
+}
+
+// dedupLog is a log held until a different log arrives or the dedup window
+// expires, counting the identical logs which follow it.
+type dedupLog struct {
+	line   []byte
+	source string
+	msg    logMessage
+	heldAt time.Time
+}
+
+// repeatDedup counts the log as a repeat of the held log if they are identical
+// and the window hasn't expired, reporting whether it was counted.
+func (l *TencentCLSLogger) repeatDedup(log *logger.Message, now time.Time) bool {
+	l.dedupMu.Lock()
+	defer l.dedupMu.Unlock()
+
+	held := l.dedup
+	if held == nil || held.source != log.Source || !bytes.Equal(held.line, log.Line) ||
+		now.Sub(held.heldAt) >= l.cfg.DedupWindow {
+		return false
+	}
+	held.msg.Repeat++
+	return true
+}
+
+// holdDedup holds the log, sending the log held before it.
+func (l *TencentCLSLogger) holdDedup(log *logger.Message, msg logMessage, now time.Time) {
+	msg.Repeat = 1
+	l.dedupMu.Lock()
+	prev := l.dedup
+	l.dedup = &dedupLog{
+		// The line buffer is reused by the caller.
+		line:   bytes.Clone(log.Line),
+		source: log.Source,
+		msg:    msg,
+		heldAt: now,
+	}
+	l.dedupMu.Unlock()
+
+	if prev != nil {
+		l.send(prev.msg)
+	}
+}
+
+// flushDedup sends the held log if it was held before the given time.
+func (l *TencentCLSLogger) flushDedup(ctx context.Context, heldBefore time.Time) {
+	l.dedupMu.Lock()
+	held := l.dedup
+	if held == nil || held.heldAt.After(heldBefore) {
+		l.dedupMu.Unlock()
+		return
+	}
+	l.dedup = nil
+	l.dedupMu.Unlock()
+
+	l.sendContext(ctx, held.msg)
+}
+
+// runDedupFlusher periodically sends the held log once the dedup window expires.
+func (l *TencentCLSLogger) runDedupFlusher() {
+	defer l.wg.Done()
+
+	ticker := l.clock.NewTicker(l.cfg.DedupWindow)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.closed:
+			return
+		case now := <-ticker.C():
+			l.flushDedup(l.sendCtx, now.Add(-l.cfg.DedupWindow))
+		}
+	}
+}
+
+// keepSample reports whether the line is kept by the sampling.
+func (l *TencentCLSLogger) keepSample(line []byte) bool {
+	if l.cfg.SampleRate >= 1 {
+		return true
+	}
+	if l.cfg.SampleKeepRegex != nil && l.cfg.SampleKeepRegex.Match(line) {
+		return true
+	}
+	return l.sample() < l.cfg.SampleRate
+}
+
+// matchFilter reports whether the line matches any or all of the filter regexes,
+// depending on the filter combine mode.
+func (l *TencentCLSLogger) matchFilter(line []byte) bool {
+	if l.cfg.FilterCombine == filterCombineAll {
+		for _, re := range l.cfg.FilterRegexes {
+			if !re.Match(line) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, re := range l.cfg.FilterRegexes {
+		if re.Match(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// runPartialLogSweeper periodically flushes partial logs which have not
+// received their last chunk within the configured timeout.
+func (l *TencentCLSLogger) runPartialLogSweeper() {
+	defer l.wg.Done()
+
+	ticker := l.clock.NewTicker(l.cfg.PartialLogTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.closed:
+			return
+		case now := <-ticker.C():
+			for _, log := range l.partialLogsBuffer.Evict(now.Add(-l.cfg.PartialLogTimeout)) {
+				l.logger.Warn("flushing stale partial log", zap.Int("size", len(log.Line)))
+				l.log(log, log.PLogMetaData.Ordinal)
+			}
+		}
+	}
+}
+
+func (l *TencentCLSLogger) send(log logMessage) {
+	if l.sendQueue != nil {
+		l.sendQueue <- log
+		return
+	}
+	l.sendContext(l.sendCtx, log)
+}
+
+// startSenders starts the workers sending the logs concurrently.
+// The queue is as long as the workers, so Log blocks once every worker
+// is busy rather than buffering the logs.
+func (l *TencentCLSLogger) startSenders(concurrency int) {
+	l.sendQueue = make(chan logMessage, concurrency)
+	l.senders.Add(concurrency)
+	for range concurrency {
+		go l.runSender()
+	}
+}
+
+// runSender sends the queued logs until the queue is closed.
+func (l *TencentCLSLogger) runSender() {
+	defer l.senders.Done()
+
+	for log := range l.sendQueue {
+		ctx := l.sendCtx
+		if l.isClosed() {
+			// Like the held dedup log, the queued logs are still sent
+			// once Close aborts the sends in progress.
+			ctx = context.Background()
+		}
+		l.sendContext(ctx, log)
+	}
+}
+
+// sendContext sends the log, abandoning it once ctx is done.
+func (l *TencentCLSLogger) sendContext(ctx context.Context, log logMessage) {
+	if l.cfg.DryRun {
+		l.logger.Debug("dry run, not sending log message", zap.String("text", log.Text), zap.Any("fields", log.Fields))
+		return
+	}
+
+	if l.cfg.SendDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.cfg.SendDeadline)
+		defer cancel()
+	} else if !l.isClosed() {
+		// Without a deadline, only Close abandons the sends, so until then
+		// the client waits for the producer without a goroutine per send.
+		ctx = context.WithoutCancel(ctx)
+	}
+
+	err := l.client.SendMessageCtx(ctx, log)
+	if err == nil {
+		return
+	}
+	if errors.Is(err, errSendAbandoned) {
+		// The client may still send the log later, so it isn't spooled
+		// nor counted as dropped.
+		l.abandoned.Add(1)
+		if errors.Is(err, context.DeadlineExceeded) {
+			l.logger.Warn("abandoned log message past the send deadline",
+				zap.Duration("deadline", l.cfg.SendDeadline), zap.String("text", log.Text), zap.Any("fields", log.Fields))
+		} else {
+			l.logger.Warn("abandoned log message on close", zap.String("text", log.Text), zap.Any("fields", log.Fields))
+		}
+		return
+	}
+
+	if l.spool != nil {
+		spoolErr := l.spool.Append(log)
+		if spoolErr == nil {
+			l.logger.Debug("spooled log message", zap.Error(err))
+			return
+		}
+		err = errors.Join(err, spoolErr)
+	}
+
+	l.dropped.Add(1)
+	l.logger.Error("failed to send log message", zap.Error(err))
+}
+
+// runSpoolReplayer periodically replays the spooled logs
+// until the client accepts them again.
+func (l *TencentCLSLogger) runSpoolReplayer() {
+	defer l.wg.Done()
+
+	ticker := l.clock.NewTicker(spoolReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.closed:
+			return
+		case <-ticker.C():
+			if l.spool.Len() == 0 {
+				continue
+			}
+			// The replay is aborted on Close, the logs left are replayed
+			// by the next logger of the container.
+			err := l.spool.Replay(func(msg logMessage) error {
+				return l.client.SendMessageCtx(l.sendCtx, msg)
+			})
+			if err != nil {
+				l.logger.Error("failed to replay spooled logs", zap.Error(err))
+			}
+		}
+	}
+}
+
+// runSchemaDescriptor periodically sends a record listing the fields the logs are sent with.
+func (l *TencentCLSLogger) runSchemaDescriptor() {
+	defer l.wg.Done()
+
+	ticker := l.clock.NewTicker(l.cfg.SchemaDescriptorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.closed:
+			return
+		case now := <-ticker.C():
+			l.send(l.schemaDescriptor(now))
+		}
+	}
+}
+
+// schemaDescriptor returns a record with the comma separated names of the fields
+// produced by the template and the client in the __schema__ field.
+func (l *TencentCLSLogger) schemaDescriptor(now time.Time) logMessage {
+	sample := l.formatter.Format(&logger.Message{
+		Line:      []byte("schema"),
+		Timestamp: now,
+	})
+
+	fields := l.client.FieldNames()
+	if l.cfg.Format == formatJSON {
+		fields = append(fields, l.cfg.JSONFields...)
+	} else {
+		for k := range l.cfg.ClientConfig.parseLog(sample) {
+			fields = append(fields, k)
+		}
+	}
+	slices.Sort(fields)
+	fields = slices.Compact(fields)
+
+	text, _ := json.Marshal(map[string]string{
+		l.cfg.ClientConfig.reservedField("schema"): strings.Join(fields, ","),
+	})
+	return logMessage{
+		Text:      string(text),
+		Timestamp: now,
+	}
+}
+
+// Stats returns the counters of the logs the logger delivered or lost.
+func (l *TencentCLSLogger) Stats() LoggerStats {
+	clientStats := l.client.Stats()
+	return LoggerStats{
+		Dropped:   l.dropped.Load(),
+		Abandoned: l.abandoned.Load(),
+		Failed:    clientStats.Failed,
+		Delivered: clientStats.Delivered,
+		Received:  l.received.Load(),
+		Bytes:     clientStats.Bytes,
+		Pending:   clientStats.Pending,
+		Sampled:   l.sampled.Load(),
+	}
+}
+
+func (l *TencentCLSLogger) runStatsReporter() {
+	defer l.wg.Done()
+
+	ticker := l.clock.NewTicker(l.cfg.StatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.closed:
+			return
+		case <-ticker.C():
+			stats := l.Stats()
+			l.logger.Info("logger stats",
+				zap.Int64("dropped", stats.Dropped),
+				zap.Int64("abandoned", stats.Abandoned),
+				zap.Int64("failed", stats.Failed),
+				zap.Int64("delivered", stats.Delivered),
+				zap.Int64("sampled", stats.Sampled),
+			)
+		}
+	}
+}
+
+// runThroughputReporter periodically logs the rates of the logs received
+// from the container since the previous report.
+func (l *TencentCLSLogger) runThroughputReporter() {
+	defer l.wg.Done()
+
+	ticker := l.clock.NewTicker(l.cfg.ThroughputInterval)
+	defer ticker.Stop()
+
+	last := l.clock.Now()
+	var lastMessages, lastBytes int64
+	for {
+		select {
+		case <-l.closed:
+			return
+		case now := <-ticker.C():
+			messages, bytes := l.received.Load(), l.receivedBytes.Load()
+			elapsed := now.Sub(last).Seconds()
+			l.logger.Info("logger throughput",
+				zap.String("container_id", l.formatter.containerDetails.ContainerID),
+				zap.Int64("messages", messages-lastMessages),
+				zap.Int64("bytes", bytes-lastBytes),
+				zap.Float64("messagesPerSec", float64(messages-lastMessages)/elapsed),
+				zap.Float64("bytesPerSec", float64(bytes-lastBytes)/elapsed),
+			)
+			last, lastMessages, lastBytes = now, messages, bytes
+		}
 	}
 }
 
 // Close implements the logger.Logger interface.
+//
+// Close stops accepting logs, sends the logs still queued or held, and closes
+// the client, which waits for Tencent CLS to acknowledge them, within the
+// close timeout. The steps share the timeout, the client being given whatever
+// time is left.
 func (l *TencentCLSLogger) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -134,14 +758,74 @@ func (l *TencentCLSLogger) Close() error {
 		return nil
 	}
 	close(l.closed)
+	l.cancelSends()
 
-	if err := l.client.Close(); err != nil {
-		l.logger.Error("failed to close Tencent CLS Client", zap.Error(err))
+	// The zero deadline doesn't limit the close.
+	var deadline time.Time
+	closeTimeout := l.cfg.ClientConfig.CloseTimeout
+	if closeTimeout > 0 {
+		deadline = l.clock.Now().Add(closeTimeout)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// The container is gone, so its counters aren't exported anymore,
+		// even if the steps below don't complete within the close timeout.
+		if l.unregisterMetrics != nil {
+			l.unregisterMetrics()
+		}
+
+		// Log checks l.closed after acquiring the read lock, so no Log call
+		// can start sending once the lock is acquired. It's released at once
+		// for the Log calls meanwhile to return errLoggerClosed.
+		l.inflight.Lock()
+		l.inflight.Unlock()
+
+		l.wg.Wait()
+		if l.sendQueue != nil {
+			// No goroutine sends once the ones above are done.
+			close(l.sendQueue)
+			l.senders.Wait()
+		}
+		if l.cfg.DedupWindow > 0 {
+			// The sends in progress are aborted, but not the held log.
+			l.flushDedup(context.Background(), l.clock.Now())
+		}
+		if err := l.client.Close(l.untilDeadline(deadline)); err != nil {
+			l.logger.Error("failed to close Tencent CLS Client", zap.Error(err))
+		}
+		if l.spool != nil {
+			if err := l.spool.Close(); err != nil {
+				l.logger.Warn("failed to close spool", zap.Error(err))
+			}
+		}
+	}()
+
+	if deadline.IsZero() {
+		<-done
+		return nil
+	}
+
+	select {
+	case <-done:
+	case <-l.clock.After(l.untilDeadline(deadline)):
+		l.logger.Warn("timed out closing Tencent CLS logger", zap.Duration("timeout", closeTimeout))
 	}
 
 	return nil
 }
 
+// untilDeadline returns the time left before the deadline, zero if it's past
+// or if the deadline is zero.
+func (l *TencentCLSLogger) untilDeadline(deadline time.Time) time.Duration {
+	if deadline.IsZero() {
+		return 0
+	}
+	return max(deadline.Sub(l.clock.Now()), 0)
+}
+
 func (l *TencentCLSLogger) isClosed() bool {
 	select {
 	case <-l.closed:
@@ -151,25 +835,85 @@ func (l *TencentCLSLogger) isClosed() bool {
 	}
 }
 
+// maxPooledBufferSize is the capacity beyond which a buffer isn't returned
+// to bufferPool, so a few large logs don't keep their memory allocated.
+const maxPooledBufferSize = 64 << 10
+
+// bufferPool holds the buffers the logs are formatted in.
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// lineOnlyTemplate is the default template, formatting the log line as is.
+const lineOnlyTemplate = "{log}"
+
 // messageFormatter is a helper struct that formats log messages.
 type messageFormatter struct {
 	template *fasttemplate.Template
+	// lineOnly is set for the default {log} template, formatted without
+	// executing the template as the log line itself.
+	lineOnly bool
+
+	// fields are the tags formatted into separate fields by FormatFields.
+	fields []string
+	// mustBeJSON requires template to format to a JSON object.
+	mustBeJSON bool
+	// missingTagPolicy is how unknown tags are formatted.
+	missingTagPolicy string
+
+	timestampFormat   string
+	timestampLocation *time.Location
 
 	containerDetails *ContainerDetails
 	attrs            map[string]string
+	ownerLabel       string
+	// hostname is the value of the {hostname} tag, resolved once.
+	hostname string
 }
 
 // newMessageFormatter creates a new messageFormatter.
-func newMessageFormatter(containerDetails *ContainerDetails, attrs map[string]string, template string) (*messageFormatter, error) {
-	t, err := fasttemplate.NewTemplate(template, "{", "}")
+func newMessageFormatter(containerDetails *ContainerDetails, cfg *loggerConfig) (*messageFormatter, error) {
+	t, err := fasttemplate.NewTemplate(cfg.Template, "{", "}")
 	if err != nil {
 		return nil, err
 	}
 
 	formatter := &messageFormatter{
-		template:         t,
-		containerDetails: containerDetails,
-		attrs:            attrs,
+		template:          t,
+		lineOnly:          cfg.Template == lineOnlyTemplate,
+		fields:            cfg.JSONFields,
+		mustBeJSON:        cfg.TemplateMustBeJSON,
+		missingTagPolicy:  cfg.MissingTagPolicy,
+		timestampFormat:   cfg.TimestampFormat,
+		timestampLocation: cfg.TimestampLocation,
+		containerDetails:  containerDetails,
+		attrs:             cfg.Attrs,
+		ownerLabel:        cfg.ClientConfig.OwnerLabel,
+		hostname:          cfg.ClientConfig.Hostname,
+	}
+
+	if formatter.hostname == "" {
+		// An unknown hostname is formatted as an empty string.
+		formatter.hostname, _ = os.Hostname()
+	}
+
+	if formatter.timestampFormat == "" {
+		formatter.timestampFormat = time.RFC3339
+	}
+	if formatter.timestampLocation == nil {
+		formatter.timestampLocation = time.UTC
 	}
 
 	if err := formatter.validateTemplate(); err != nil {
@@ -181,63 +925,264 @@ func newMessageFormatter(containerDetails *ContainerDetails, attrs map[string]st
 
 // Format formats the given message.
 func (f *messageFormatter) Format(msg *logger.Message) string {
-	return f.template.ExecuteFuncString(f.tagFunc(msg))
+	if f.lineOnly {
+		return string(msg.Line)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	// The tags are validated by newMessageFormatter, and writing to a buffer can't fail.
+	_, _ = f.FormatTo(buf, msg)
+	return buf.String()
+}
+
+// FormatTo writes the formatted message to w.
+func (f *messageFormatter) FormatTo(w io.Writer, msg *logger.Message) (int64, error) {
+	if f.lineOnly {
+		n, err := w.Write(msg.Line)
+		return int64(n), err
+	}
+	return f.template.ExecuteFunc(w, f.tagFunc(msg))
+}
+
+// FormatFields formats the given message into a field per configured tag.
+func (f *messageFormatter) FormatFields(msg *logger.Message) map[string]string {
+	fields := make(map[string]string, len(f.fields))
+	tagFunc := f.tagFunc(msg)
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	for _, tag := range f.fields {
+		buf.Reset()
+		if _, err := tagFunc(buf, tag); err != nil {
+			continue
+		}
+		fields[tag] = buf.String()
+	}
+	return fields
 }
 
-// validateTemplate validates the template.
+// validateTemplate validates the template and the field tags.
 func (f *messageFormatter) validateTemplate() error {
 	msg := &logger.Message{
 		Line:      []byte("validate"),
 		Timestamp: time.Now(),
 	}
-	_, err := f.template.ExecuteFuncStringWithErr(f.tagFunc(msg))
-	return err
+	if f.mustBeJSON {
+		// The container is expected to log JSON objects as well.
+		msg.Line = []byte(`{"validate":true}`)
+	}
+
+	// Unknown tags are collected to report them all at once.
+	var unknownTags []string
+	tagFunc := f.tagFunc(msg)
+	collectTagFunc := func(w io.Writer, tag string) (int, error) {
+		n, err := tagFunc(w, tag)
+		if errors.Is(err, errUnknownTag) {
+			if !slices.Contains(unknownTags, tag) {
+				unknownTags = append(unknownTags, tag)
+			}
+			return n, nil
+		}
+		return n, err
+	}
+
+	text, err := f.template.ExecuteFuncStringWithErr(collectTagFunc)
+	if err != nil {
+		return err
+	}
+	for _, tag := range f.fields {
+		if _, err := collectTagFunc(io.Discard, tag); err != nil {
+			return err
+		}
+	}
+	if len(unknownTags) > 0 {
+		return fmt.Errorf("%w: %s", errUnknownTag, strings.Join(unknownTags, ", "))
+	}
+
+	if f.mustBeJSON {
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(text), &fields); err != nil {
+			return fmt.Errorf("template doesn't format to a JSON object: %w", err)
+		}
+	}
+	return nil
 }
 
-// tagFunc is a fasttemplate.TagFunc that replaces tags with values.
+// tagFunc is a fasttemplate.TagFunc that replaces tags with values,
+// transformed by the modifiers following the tag name if any.
 func (f *messageFormatter) tagFunc(msg *logger.Message) fasttemplate.TagFunc {
+	writeTag := f.writeTagFunc(msg)
+	return func(w io.Writer, tag string) (int, error) {
+		name, modifiers, ok := strings.Cut(tag, tagModifierSeparator)
+		if !ok {
+			return writeTag(w, tag)
+		}
+
+		modify, err := parseTagModifiers(modifiers)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s", err, tag)
+		}
+		buf := getBuffer()
+		defer putBuffer(buf)
+		if _, err := writeTag(buf, name); err != nil {
+			return 0, err
+		}
+		return w.Write(modify(buf.Bytes()))
+	}
+}
+
+// parseTagModifiers parses the modifiers of a tag separated by tagModifierSeparator,
+// e.g. "upper:truncate:512", returning a function applying them in order.
+func parseTagModifiers(modifiers string) (func([]byte) []byte, error) {
+	var funcs []func([]byte) []byte
+	args := strings.Split(modifiers, tagModifierSeparator)
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "upper":
+			funcs = append(funcs, bytes.ToUpper)
+		case "lower":
+			funcs = append(funcs, bytes.ToLower)
+		case "truncate":
+			i++
+			if i == len(args) {
+				return nil, fmt.Errorf("%w: truncate requires a size", errUnknownTagModifier)
+			}
+			size, err := strconv.Atoi(args[i])
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("%w: invalid truncate size %q", errUnknownTagModifier, args[i])
+			}
+			funcs = append(funcs, func(b []byte) []byte { return truncateUTF8(b, size) })
+		default:
+			return nil, fmt.Errorf("%w: %s", errUnknownTagModifier, args[i])
+		}
+	}
+
+	return func(b []byte) []byte {
+		for _, fn := range funcs {
+			b = fn(b)
+		}
+		return b
+	}, nil
+}
+
+// truncateUTF8 truncates b to at most size bytes without splitting a rune.
+func truncateUTF8(b []byte, size int) []byte {
+	if len(b) <= size {
+		return b
+	}
+	for size > 0 && !utf8.RuneStart(b[size]) {
+		size--
+	}
+	return b[:size]
+}
+
+// writeTagFunc returns a fasttemplate.TagFunc writing the value of a tag without modifiers.
+func (f *messageFormatter) writeTagFunc(msg *logger.Message) fasttemplate.TagFunc {
 	return func(w io.Writer, tag string) (int, error) {
 		switch tag {
 		case "log":
 			return w.Write(msg.Line)
 		case "timestamp":
-			return w.Write([]byte(msg.Timestamp.UTC().Format(time.RFC3339)))
-		case "container_id":
-			return w.Write([]byte(f.containerDetails.ID()))
+			return io.WriteString(w, msg.Timestamp.In(f.timestampLocation).Format(f.timestampFormat))
+		case "source":
+			return io.WriteString(w, msg.Source)
+		case "container_id", "container_short_id":
+			return io.WriteString(w, f.containerDetails.ID())
 		case "container_full_id":
-			return w.Write([]byte(f.containerDetails.ContainerID))
+			return io.WriteString(w, f.containerDetails.ContainerID)
 		case "container_name":
-			return w.Write([]byte(f.containerDetails.Name()))
+			return io.WriteString(w, f.containerDetails.Name())
 		case "image_id":
-			return w.Write([]byte(f.containerDetails.ImageID()))
+			return io.WriteString(w, f.containerDetails.ImageID())
 		case "image_full_id":
-			return w.Write([]byte(f.containerDetails.ContainerImageID))
+			return io.WriteString(w, f.containerDetails.ContainerImageID)
 		case "image_name":
-			return w.Write([]byte(f.containerDetails.ImageName()))
+			return io.WriteString(w, f.containerDetails.ImageName())
 		case "daemon_name":
-			return w.Write([]byte(f.containerDetails.DaemonName))
+			return io.WriteString(w, f.containerDetails.DaemonName)
+		case "owner":
+			return io.WriteString(w, containerOwner(f.containerDetails, f.ownerLabel))
+		case "k8s_pod_uid":
+			return io.WriteString(w, f.containerDetails.ContainerLabels[k8sPodUIDLabel])
+		case "hostname":
+			return io.WriteString(w, f.hostname)
+		case "container_created":
+			return io.WriteString(w, formatContainerCreated(f.containerDetails.ContainerCreated, f.timestampLocation))
+		}
+
+		// Labels and env vars may be absent on some containers,
+		// so unknown keys are formatted as empty strings.
+		if key, ok := strings.CutPrefix(tag, labelTagPrefix); ok {
+			return io.WriteString(w, f.containerDetails.ContainerLabels[key])
+		}
+		if key, ok := strings.CutPrefix(tag, envTagPrefix); ok {
+			return io.WriteString(w, containerEnv(f.containerDetails, key))
 		}
 
 		if value, ok := f.attrs[tag]; ok {
-			return w.Write([]byte(value))
+			return io.WriteString(w, value)
+		}
+
+		switch f.missingTagPolicy {
+		case missingTagPolicyEmpty:
+			return 0, nil
+		case missingTagPolicyLiteral:
+			return io.WriteString(w, "{"+tag+"}")
 		}
 
 		return 0, fmt.Errorf("%w: %s", errUnknownTag, tag)
 	}
 }
 
+// containerOwner returns the value of the owner label of the container,
+// or an empty string if the label is not configured or not set.
+func containerOwner(containerDetails *ContainerDetails, ownerLabel string) string {
+	if ownerLabel == "" {
+		return ""
+	}
+	return containerDetails.ContainerLabels[ownerLabel]
+}
+
+// containerEnv returns the value of the env var of the container,
+// or an empty string if it is not set.
+func containerEnv(containerDetails *ContainerDetails, key string) string {
+	for _, env := range containerDetails.ContainerEnv {
+		if k, v, _ := strings.Cut(env, "="); k == key {
+			return v
+		}
+	}
+	return ""
+}
+
 type partialLogBuffer struct {
-	logs map[string]*logger.Message
+	logs map[string]*partialLog
 	mu   sync.Mutex
+	// initialSize is the capacity allocated to assemble a log.
+	initialSize int
+	// maxSize is the size beyond which an assembled log is flushed
+	// before its last partial message. Zero disables the limit.
+	maxSize int
+}
+
+// partialLog is a log being assembled from partial messages.
+type partialLog struct {
+	msg *logger.Message
+	// updatedAt is the time the last partial message was appended.
+	updatedAt time.Time
 }
 
-func newPartialLogBuffer() *partialLogBuffer {
+func newPartialLogBuffer(initialSize, maxSize int) *partialLogBuffer {
 	return &partialLogBuffer{
-		logs: map[string]*logger.Message{},
+		logs:        map[string]*partialLog{},
+		initialSize: initialSize,
+		maxSize:     maxSize,
 	}
 }
 
-func (b *partialLogBuffer) Append(log *logger.Message) (*logger.Message, bool) {
+// Append adds the partial message received at now to the log it's a part of
+// and returns the log once complete. A log reaching maxSize is returned before its last partial
+// message, with PLogMetaData.Last unset, and the following ones start a new log.
+func (b *partialLogBuffer) Append(log *logger.Message, now time.Time) (*logger.Message, bool) {
 	if log.PLogMetaData == nil {
 		panic("log must be partial")
 	}
@@ -245,23 +1190,45 @@ func (b *partialLogBuffer) Append(log *logger.Message) (*logger.Message, bool) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	plog, exists := b.logs[log.PLogMetaData.ID]
+	entry, exists := b.logs[log.PLogMetaData.ID]
 	if !exists {
-		plog = new(logger.Message)
+		plog := new(logger.Message)
 		*plog = *log
 
-		b.logs[plog.PLogMetaData.ID] = plog
+		entry = &partialLog{msg: plog}
+		b.logs[plog.PLogMetaData.ID] = entry
 
-		plog.Line = make([]byte, 0, 16*1024) // 16KB. Arbitrary size
-		plog.PLogMetaData = nil
+		plog.Line = make([]byte, 0, b.initialSize)
+		plog.PLogMetaData = &backend.PartialLogMetaData{ID: log.PLogMetaData.ID}
 	}
 
-	plog.Line = append(plog.Line, log.Line...)
+	entry.msg.Line = append(entry.msg.Line, log.Line...)
+	// The assembled log keeps the metadata of its last partial message,
+	// with Ordinal counting the partial messages it was assembled from.
+	entry.msg.PLogMetaData.Ordinal++
+	entry.msg.PLogMetaData.Last = log.PLogMetaData.Last
+	entry.updatedAt = now
 
-	if log.PLogMetaData.Last {
+	if log.PLogMetaData.Last || (b.maxSize > 0 && len(entry.msg.Line) >= b.maxSize) {
 		delete(b.logs, log.PLogMetaData.ID)
-		return plog, true
+		return entry.msg, true
 	}
 
 	return nil, false
 }
+
+// Evict removes the partial logs which were last appended to before the given time
+// and returns whatever was assembled for them so far.
+func (b *partialLogBuffer) Evict(before time.Time) []*logger.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var evicted []*logger.Message
+	for id, entry := range b.logs {
+		if entry.updatedAt.Before(before) {
+			delete(b.logs, id)
+			evicted = append(evicted, entry.msg)
+		}
+	}
+	return evicted
+}
@@ -2,27 +2,107 @@ package main
 
 import (
 	"fmt"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/docker/go-units"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
 )
 
 const (
 	cfgEndpointKey                   = "endpoint"
+	cfgRegionKey                     = "region"
 	cfgSecretIDKey                   = "secret_id"
 	cfgSecretKeyKey                  = "secret_key"
+	cfgSecurityTokenKey              = "security_token"
+	cfgSecretIDFileKey               = "secret_id_file"
+	cfgSecretKeyFileKey              = "secret_key_file"
 	cfgTopicIDKey                    = "topic_id"
 	cfgRetriesKey                    = "retries"
 	cfgTimeoutKey                    = "timeout"
+	cfgRetryInitialIntervalKey       = "retry-initial-interval"
+	cfgRetryMaxIntervalKey           = "retry-max-interval"
+	cfgCompressKey                   = "cls-compress"
+	cfgBatchMaxBytesKey              = "batch-max-bytes"
+	cfgBatchMaxMessagesKey           = "batch-max-messages"
+	cfgShareProducerKey              = "share-producer"
+	cfgProxyKey                      = "proxy"
+	cfgCloseTimeoutKey               = "close-timeout"
+	cfgEnqueueTimeoutKey             = "enqueue-timeout"
 	cfgInstanceInfoKey               = "instance_info"
 	cfgAppendContainerDetailsKeysKey = "append_container_details_keys"
+	cfgContainerDetailsModeKey       = "container-details-mode"
+	cfgOrderingKey                   = "ordering"
+	cfgAppendSourceKey               = "append-source"
+	cfgAppendK8sPodUIDKey            = "append-k8s-pod-uid"
+	cfgEmitBufferDepthKey            = "emit-buffer-depth"
+	cfgEmitIngestLatencyKey          = "emit-ingest-latency"
+	cfgEmitSizeBucketKey             = "emit-size-bucket"
+	cfgEmitDockerTruncationKey       = "emit-docker-truncation"
+	cfgEmitLogModeKey                = "emit-log-mode"
+	cfgPartitionFieldKey             = "partition-field"
+	cfgOutputSinkKey                 = "output-sink"
+	cfgOwnerLabelKey                 = "owner-label"
+	cfgTopicLabelKey                 = "topic-label"
+	cfgFanoutTopicsKey               = "fanout-topics"
+	cfgRedactFieldsKey               = "redact-fields"
+	cfgCallerFieldsKey               = "caller-fields"
+	cfgFlattenJSONKey                = "flatten-json"
+	cfgIncludeRawKey                 = "include-raw"
+	cfgRawFieldNameKey               = "raw-field-name"
+	cfgFieldPrefixKey                = "field-prefix"
+	cfgMaxFieldsKey                  = "max-fields"
+	cfgAppendHostnameKey             = "append-hostname"
+	cfgHostnameKey                   = "hostname"
+	cfgStaticFieldsKey               = "static-fields"
+	cfgTimePrecisionKey              = "time-precision"
+	cfgConfigFileKey                 = "config-file"
+	cfgParseFormatKey                = "parse-format"
+	cfgVerifyCredentialsKey          = "verify-credentials"
 
 	cfgNoFileKey   = "no-file"
 	cfgKeepFileKey = "keep-file"
 
-	cfgTemplateKey    = "template"
-	cfgFilterRegexKey = "filter-regex"
+	// cfgModeKey is the Docker log delivery mode option.
+	cfgModeKey = "mode"
+
+	cfgTemplateKey           = "template"
+	cfgTemplateMustBeJSONKey = "template-must-be-json"
+	cfgMissingTagPolicyKey   = "missing-tag-policy"
+	cfgFormatKey             = "format"
+	cfgTimestampFormatKey    = "timestamp-format"
+	cfgTimestampTimezoneKey  = "timestamp-timezone"
+	cfgJSONFieldsKey         = "json-fields"
+	cfgFilterRegexKey        = "filter-regex"
+	cfgFilterModeKey         = "filter-mode"
+	cfgFilterCombineKey      = "filter-combine"
+	cfgLevelRegexKey         = "level-regex"
+	cfgSampleRateKey         = "sample-rate"
+	cfgSampleKeepRegexKey    = "sample-keep-regex"
+	cfgDedupWindowKey        = "dedup-window"
+	cfgSendConcurrencyKey    = "send-concurrency"
+	cfgInvalidUTF8Key        = "invalid-utf8"
+	cfgPartialLogTimeoutKey  = "partial-log-timeout"
+
+	cfgSchemaDescriptorIntervalKey = "schema-descriptor-interval"
+	cfgPartialLogInitialSizeKey    = "partial-log-initial-size"
+	cfgPartialLogMaxSizeKey        = "partial-log-max-size"
+	cfgSendDeadlineKey             = "send-deadline"
+	cfgEnableIfEnvKey              = "enable-if-env"
+	cfgStatsIntervalKey            = "stats-interval"
+	cfgThroughputIntervalKey       = "throughput-interval"
+	cfgSpoolDirKey                 = "spool-dir"
+	cfgSpoolMaxSizeKey             = "spool-max-size"
+	cfgHealthcheckOnStartKey       = "healthcheck-on-start"
+	cfgDryRunKey                   = "dry-run"
+	cfgMetricsAddrKey              = "metrics-addr"
 )
 
 type loggerConfig struct {
@@ -30,27 +110,235 @@ type loggerConfig struct {
 
 	Attrs map[string]string
 
-	Template    string
-	FilterRegex *regexp.Regexp
+	Template string
+	// TemplateMustBeJSON fails the logger creation when Template
+	// doesn't format to a JSON object which can be parsed into fields.
+	TemplateMustBeJSON bool
+	// MissingTagPolicy is how unknown template tags are formatted: "error"
+	// (default) fails the logger creation, "empty" formats them as empty
+	// strings and "literal" keeps them as is, e.g. "{tag}".
+	MissingTagPolicy string
+	// Format is "text" to send the log formatted by Template,
+	// or "json" to send a field per tag listed in JSONFields.
+	Format     string
+	JSONFields []string
+
+	// TimestampFormat is the Go time layout of the {timestamp} tag.
+	TimestampFormat string
+	// TimestampLocation is the time zone of the {timestamp} and {container_created} tags.
+	TimestampLocation *time.Location
+
+	// FilterRegexes are the patterns of the filter-regex option, one per line.
+	FilterRegexes []*regexp.Regexp
+	// FilterMode is "include" to keep only the logs matching the filter,
+	// or "exclude" to drop them.
+	FilterMode string
+	// FilterCombine is "any" to match a log when one of FilterRegexes matches,
+	// or "all" to match it only when every pattern matches.
+	FilterCombine string
+
+	// InvalidUTF8 is how the logs which aren't valid UTF-8, as Tencent CLS requires,
+	// are handled: "raw" to send them as is, "replace" to replace the invalid bytes
+	// with U+FFFD, or "drop" to drop the logs.
+	InvalidUTF8 string
+
+	// LevelRegex extracts the level of the log line from its first capture group.
+	LevelRegex *regexp.Regexp
+
+	// SampleRate is the fraction, between 0 and 1, of the logs kept after filtering.
+	SampleRate float64
+	// SampleKeepRegex matches the logs which are always kept by the sampling.
+	SampleKeepRegex *regexp.Regexp
+
+	// DedupWindow is the time identical consecutive logs are collapsed
+	// into the first one, sent with their count. Zero disables the deduplication.
+	DedupWindow time.Duration
 
 	MaxBufferSize int64
 
 	BatchFlushInterval time.Duration
+
+	// PartialLogTimeout is the time after which a partial log which never received
+	// its last chunk is flushed as is. Zero disables the eviction.
+	PartialLogTimeout time.Duration
+	// PartialLogInitialSize is the capacity in bytes allocated to assemble
+	// a log from partial messages, grown as needed.
+	PartialLogInitialSize int64
+	// PartialLogMaxSize is the size in bytes beyond which a log assembled from
+	// partial messages is flushed before its last one. Zero disables the limit.
+	PartialLogMaxSize int64
+
+	// SendDeadline is the time after which a log the client is still sending
+	// is abandoned and counted as dropped. Zero disables the deadline.
+	SendDeadline time.Duration
+
+	// SendConcurrency is the number of logs sent at once by as many workers,
+	// which may reorder them. Up to 1 sends the logs in order as they are logged.
+	SendConcurrency int
+
+	// SchemaDescriptorInterval is the interval to send a record listing the fields
+	// the logs are sent with. Zero disables the record.
+	SchemaDescriptorInterval time.Duration
+
+	// StatsInterval is the interval to log the counters of the lost logs.
+	// Zero disables the logging.
+	StatsInterval time.Duration
+
+	// ThroughputInterval is the interval to log the rates of the logs received
+	// from the container. Zero disables the logging.
+	ThroughputInterval time.Duration
+
+	// SpoolDir is the directory the logs the client fails to send are spooled to
+	// until they can be replayed. Empty disables the spool.
+	SpoolDir string
+	// SpoolMaxSize is the maximum size in bytes of the spool of a container.
+	SpoolMaxSize int64
+
+	// HealthcheckOnStart fails the logger creation when the health check
+	// of the client fails, e.g. with invalid credentials.
+	HealthcheckOnStart bool
+
+	// MetricsAddr is the address to serve the counters of the logs
+	// in the Prometheus format at /metrics. Empty disables the server.
+	MetricsAddr string
+
+	// DryRun logs the logs at debug level instead of sending them,
+	// to check the options without shipping logs.
+	DryRun bool
+
+	// EnableIfEnv is the container env var which must be set to a true value
+	// for the logs to be shipped.
+	EnableIfEnv string
+	// Disabled drops every log, set when the EnableIfEnv env var isn't true.
+	Disabled bool
 }
 
 var defaultLoggerConfig = loggerConfig{
-	Template:           "{log}",
+	Template:           lineOnlyTemplate,
+	MissingTagPolicy:   missingTagPolicyError,
+	Format:             formatText,
+	TimestampFormat:    time.RFC3339,
+	TimestampLocation:  time.UTC,
+	FilterMode:         filterModeInclude,
+	FilterCombine:      filterCombineAny,
+	InvalidUTF8:        invalidUTF8Raw,
+	SampleRate:         1,
 	BatchFlushInterval: 3 * time.Second,
 	MaxBufferSize:      1e6, // 1MB
+	SpoolMaxSize:       64 << 20,
+	PartialLogTimeout:  time.Minute,
+	// Docker splits the logs into partial messages of 16KB.
+	PartialLogInitialSize: 16 << 10,
+	PartialLogMaxSize:     1 << 20,
 }
 
+// clsRegions are the regions Tencent CLS is available in.
+// The endpoint of a region is "<region>.cls.tencentcs.com".
+var clsRegions = map[string]struct{}{
+	"ap-beijing":       {},
+	"ap-beijing-fsi":   {},
+	"ap-shanghai":      {},
+	"ap-shanghai-fsi":  {},
+	"ap-guangzhou":     {},
+	"ap-shenzhen-fsi":  {},
+	"ap-nanjing":       {},
+	"ap-chengdu":       {},
+	"ap-chongqing":     {},
+	"ap-hongkong":      {},
+	"ap-taipei":        {},
+	"ap-singapore":     {},
+	"ap-bangkok":       {},
+	"ap-jakarta":       {},
+	"ap-mumbai":        {},
+	"ap-seoul":         {},
+	"ap-tokyo":         {},
+	"na-siliconvalley": {},
+	"na-ashburn":       {},
+	"na-toronto":       {},
+	"sa-saopaulo":      {},
+	"eu-frankfurt":     {},
+	"eu-moscow":        {},
+}
+
+const (
+	modeBlocking    = "blocking"
+	modeNonBlocking = "non-blocking"
+
+	missingTagPolicyError   = "error"
+	missingTagPolicyEmpty   = "empty"
+	missingTagPolicyLiteral = "literal"
+
+	formatText = "text"
+	formatJSON = "json"
+
+	filterModeInclude = "include"
+	filterModeExclude = "exclude"
+
+	filterCombineAny = "any"
+	filterCombineAll = "all"
+
+	invalidUTF8Raw     = "raw"
+	invalidUTF8Replace = "replace"
+	invalidUTF8Drop    = "drop"
+
+	containerDetailsModeFlat   = "flat"
+	containerDetailsModeNested = "nested"
+
+	// maxBatchBytes is the size limit of an upload request to Tencent CLS.
+	maxBatchBytes = 5 << 20
+	// maxBatchMessages is the maximum number of logs the producer batches.
+	maxBatchMessages = 40960
+
+	compressLZ4  = "lz4"
+	compressZstd = "zstd"
+
+	partitionHour = "hour"
+	partitionDay  = "day"
+
+	parseFormatJSON   = "json"
+	parseFormatLogfmt = "logfmt"
+	parseFormatNone   = "none"
+
+	timePrecisionSecond      = "s"
+	timePrecisionMillisecond = "ms"
+
+	orderingNone         = "none"
+	orderingPerContainer = "per-container"
+)
+
+// clsFieldNameRegexp matches the field names Tencent CLS accepts.
+var clsFieldNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_./@-]{0,255}$`)
+
+// The env vars of the plugin the client options fall back on when absent,
+// e.g. set with docker plugin set. The options take precedence.
+const (
+	endpointEnv  = "CLS_ENDPOINT"
+	secretIDEnv  = "CLS_SECRET_ID"
+	secretKeyEnv = "CLS_SECRET_KEY"
+	topicIDEnv   = "CLS_TOPIC_ID"
+)
+
 var defaultClientConfig = ClientConfig{
-	Retries: 5,
-	Timeout: 10 * time.Second,
+	Retries:      5,
+	MaxFields:    1000,
+	Timeout:      10 * time.Second,
+	CloseTimeout: 10 * time.Second,
 }
 
-func parseLoggerConfig(containerDetails *ContainerDetails) (*loggerConfig, error) {
-	clientConfig, err := parseClientConfig(containerDetails)
+func parseLoggerConfig(logger *zap.Logger, containerDetails *ContainerDetails) (*loggerConfig, error) {
+	if configFile := containerDetails.Config[cfgConfigFileKey]; configFile != "" {
+		opts, err := readConfigFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q option: %w", cfgConfigFileKey, err)
+		}
+		// The inline options take precedence over the file.
+		maps.Copy(opts, containerDetails.Config)
+		merged := *containerDetails
+		merged.Config = opts
+		containerDetails = &merged
+	}
+
+	clientConfig, err := parseClientConfig(logger, containerDetails)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse client config: %w", err)
 	}
@@ -66,11 +354,246 @@ func parseLoggerConfig(containerDetails *ContainerDetails) (*loggerConfig, error
 	if template, ok := containerDetails.Config[cfgTemplateKey]; ok {
 		cfg.Template = template
 	}
+	cfg.TemplateMustBeJSON, err = parseBool(containerDetails.Config[cfgTemplateMustBeJSONKey], false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q option: %w", cfgTemplateMustBeJSONKey, err)
+	}
+	if policy, ok := containerDetails.Config[cfgMissingTagPolicyKey]; ok {
+		switch policy {
+		case missingTagPolicyError, missingTagPolicyEmpty, missingTagPolicyLiteral:
+			cfg.MissingTagPolicy = policy
+		default:
+			return nil, fmt.Errorf("invalid %q option: %s", cfgMissingTagPolicyKey, policy)
+		}
+	}
+
+	if format, ok := containerDetails.Config[cfgFormatKey]; ok {
+		switch format {
+		case formatText, formatJSON:
+			cfg.Format = format
+		default:
+			return nil, fmt.Errorf("invalid %q option: %s", cfgFormatKey, format)
+		}
+	}
+	if jsonFields := containerDetails.Config[cfgJSONFieldsKey]; jsonFields != "" {
+		cfg.JSONFields = strings.Split(jsonFields, ",")
+	}
+	if cfg.Format == formatJSON && len(cfg.JSONFields) == 0 {
+		return nil, fmt.Errorf("%q option is required with %s=%s", cfgJSONFieldsKey, cfgFormatKey, formatJSON)
+	}
+
+	if timestampFormat, ok := containerDetails.Config[cfgTimestampFormatKey]; ok {
+		if time.Now().Format(timestampFormat) == "" {
+			return nil, fmt.Errorf("invalid %q option: %q formats to an empty string", cfgTimestampFormatKey, timestampFormat)
+		}
+		cfg.TimestampFormat = timestampFormat
+	}
+	if timezone, ok := containerDetails.Config[cfgTimestampTimezoneKey]; ok {
+		cfg.TimestampLocation, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q option: %w", cfgTimestampTimezoneKey, err)
+		}
+	}
+	cfg.ClientConfig.TimestampLocation = cfg.TimestampLocation
 
 	if filterRegex, ok := containerDetails.Config[cfgFilterRegexKey]; ok {
-		cfg.FilterRegex, err = regexp.Compile(filterRegex)
+		// Patterns are separated by newlines only, as commas are valid regex syntax, e.g. "a{1,3}".
+		for _, pattern := range strings.Split(filterRegex, "\n") {
+			if strings.TrimSpace(pattern) == "" {
+				continue
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %q option: pattern %q: %w", cfgFilterRegexKey, pattern, err)
+			}
+			cfg.FilterRegexes = append(cfg.FilterRegexes, re)
+		}
+	}
+
+	if levelRegex, ok := containerDetails.Config[cfgLevelRegexKey]; ok {
+		cfg.LevelRegex, err = regexp.Compile(levelRegex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q option: %w", cfgLevelRegexKey, err)
+		}
+		if cfg.LevelRegex.NumSubexp() == 0 {
+			return nil, fmt.Errorf("invalid %q option: %q has no capture group", cfgLevelRegexKey, levelRegex)
+		}
+	}
+
+	if sampleRate, ok := containerDetails.Config[cfgSampleRateKey]; ok {
+		cfg.SampleRate, err = strconv.ParseFloat(sampleRate, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q option: %w", cfgSampleRateKey, err)
+		}
+		if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+			return nil, fmt.Errorf("invalid %q option: %s", cfgSampleRateKey, sampleRate)
+		}
+	}
+	if sampleKeepRegex, ok := containerDetails.Config[cfgSampleKeepRegexKey]; ok {
+		cfg.SampleKeepRegex, err = regexp.Compile(sampleKeepRegex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q option: %w", cfgSampleKeepRegexKey, err)
+		}
+	}
+
+	if dedupWindow, ok := containerDetails.Config[cfgDedupWindowKey]; ok {
+		cfg.DedupWindow, err = time.ParseDuration(dedupWindow)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q option: %w", cfgDedupWindowKey, err)
+		}
+		if cfg.DedupWindow < 0 {
+			return nil, fmt.Errorf("invalid %q option: %s", cfgDedupWindowKey, dedupWindow)
+		}
+	}
+
+	if filterCombine, ok := containerDetails.Config[cfgFilterCombineKey]; ok {
+		switch filterCombine {
+		case filterCombineAny, filterCombineAll:
+			cfg.FilterCombine = filterCombine
+		default:
+			return nil, fmt.Errorf("invalid %q option: %s", cfgFilterCombineKey, filterCombine)
+		}
+	}
+
+	if filterMode, ok := containerDetails.Config[cfgFilterModeKey]; ok {
+		switch filterMode {
+		case filterModeInclude, filterModeExclude:
+			cfg.FilterMode = filterMode
+		default:
+			return nil, fmt.Errorf("invalid %q option: %s", cfgFilterModeKey, filterMode)
+		}
+	}
+
+	if invalidUTF8, ok := containerDetails.Config[cfgInvalidUTF8Key]; ok {
+		switch invalidUTF8 {
+		case invalidUTF8Raw, invalidUTF8Replace, invalidUTF8Drop:
+			cfg.InvalidUTF8 = invalidUTF8
+		default:
+			return nil, fmt.Errorf("invalid %q option: %s", cfgInvalidUTF8Key, invalidUTF8)
+		}
+	}
+
+	if partialLogTimeout, ok := containerDetails.Config[cfgPartialLogTimeoutKey]; ok {
+		cfg.PartialLogTimeout, err = time.ParseDuration(partialLogTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q option: %w", cfgPartialLogTimeoutKey, err)
+		}
+		if cfg.PartialLogTimeout < 0 {
+			return nil, fmt.Errorf("invalid %q option: %s", cfgPartialLogTimeoutKey, partialLogTimeout)
+		}
+	}
+
+	if initialSize, ok := containerDetails.Config[cfgPartialLogInitialSizeKey]; ok {
+		cfg.PartialLogInitialSize, err = units.RAMInBytes(initialSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q option: %w", cfgPartialLogInitialSizeKey, err)
+		}
+		if cfg.PartialLogInitialSize < 0 || cfg.PartialLogInitialSize > maxBatchBytes {
+			return nil, fmt.Errorf("invalid %q option: %s", cfgPartialLogInitialSizeKey, initialSize)
+		}
+	}
+
+	if maxSize, ok := containerDetails.Config[cfgPartialLogMaxSizeKey]; ok {
+		cfg.PartialLogMaxSize, err = units.RAMInBytes(maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q option: %w", cfgPartialLogMaxSizeKey, err)
+		}
+		if cfg.PartialLogMaxSize < 0 {
+			return nil, fmt.Errorf("invalid %q option: %s", cfgPartialLogMaxSizeKey, maxSize)
+		}
+	}
+
+	if deadline, ok := containerDetails.Config[cfgSendDeadlineKey]; ok {
+		cfg.SendDeadline, err = time.ParseDuration(deadline)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q option: %w", cfgSendDeadlineKey, err)
+		}
+		if cfg.SendDeadline < 0 {
+			return nil, fmt.Errorf("invalid %q option: %s", cfgSendDeadlineKey, deadline)
+		}
+	}
+
+	if concurrency, ok := containerDetails.Config[cfgSendConcurrencyKey]; ok {
+		cfg.SendConcurrency, err = strconv.Atoi(concurrency)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q option: %w", cfgSendConcurrencyKey, err)
+		}
+		if cfg.SendConcurrency < 0 {
+			return nil, fmt.Errorf("invalid %q option: %s", cfgSendConcurrencyKey, concurrency)
+		}
+		if cfg.SendConcurrency > 1 && clientConfig.Ordering == orderingPerContainer {
+			return nil, fmt.Errorf("%q option above 1 can't be used with %s=%s, as the workers reorder the logs", cfgSendConcurrencyKey, cfgOrderingKey, orderingPerContainer)
+		}
+	}
+
+	if interval, ok := containerDetails.Config[cfgSchemaDescriptorIntervalKey]; ok {
+		cfg.SchemaDescriptorInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q option: %w", cfgSchemaDescriptorIntervalKey, err)
+		}
+		if cfg.SchemaDescriptorInterval < 0 {
+			return nil, fmt.Errorf("invalid %q option: %s", cfgSchemaDescriptorIntervalKey, interval)
+		}
+	}
+
+	if interval, ok := containerDetails.Config[cfgStatsIntervalKey]; ok {
+		cfg.StatsInterval, err = time.ParseDuration(interval)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse %q option: %w", cfgFilterRegexKey, err)
+			return nil, fmt.Errorf("failed to parse %q option: %w", cfgStatsIntervalKey, err)
+		}
+		if cfg.StatsInterval < 0 {
+			return nil, fmt.Errorf("invalid %q option: %s", cfgStatsIntervalKey, interval)
+		}
+	}
+
+	if interval, ok := containerDetails.Config[cfgThroughputIntervalKey]; ok {
+		cfg.ThroughputInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q option: %w", cfgThroughputIntervalKey, err)
+		}
+		if cfg.ThroughputInterval < 0 {
+			return nil, fmt.Errorf("invalid %q option: %s", cfgThroughputIntervalKey, interval)
+		}
+	}
+
+	if dir := containerDetails.Config[cfgSpoolDirKey]; dir != "" {
+		// Each container has its own spool to replay its logs only.
+		cfg.SpoolDir = filepath.Join(dir, containerDetails.ContainerID)
+	}
+	if maxSize, ok := containerDetails.Config[cfgSpoolMaxSizeKey]; ok {
+		cfg.SpoolMaxSize, err = units.RAMInBytes(maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q option: %w", cfgSpoolMaxSizeKey, err)
+		}
+		if cfg.SpoolMaxSize <= 0 {
+			return nil, fmt.Errorf("invalid %q option: %s", cfgSpoolMaxSizeKey, maxSize)
+		}
+	}
+
+	cfg.HealthcheckOnStart, err = parseBool(containerDetails.Config[cfgHealthcheckOnStartKey], false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q option: %w", cfgHealthcheckOnStartKey, err)
+	}
+
+	cfg.DryRun, err = parseBool(containerDetails.Config[cfgDryRunKey], false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q option: %w", cfgDryRunKey, err)
+	}
+
+	if metricsAddr := containerDetails.Config[cfgMetricsAddrKey]; metricsAddr != "" {
+		if _, _, err := net.SplitHostPort(metricsAddr); err != nil {
+			return nil, fmt.Errorf("invalid %q option: %w", cfgMetricsAddrKey, err)
+		}
+		cfg.MetricsAddr = metricsAddr
+	}
+
+	if env := containerDetails.Config[cfgEnableIfEnvKey]; env != "" {
+		cfg.EnableIfEnv = env
+		// An unset or unparsable value disables the logs as well.
+		enabled, _ := strconv.ParseBool(containerEnv(containerDetails, env))
+		cfg.Disabled = !enabled
+		if cfg.Disabled {
+			logger.Info("logs are not shipped for the container", zap.String("env", env))
 		}
 	}
 
@@ -88,20 +611,115 @@ func (c loggerConfig) Validate(opts map[string]string) error {
 	return c.ClientConfig.Validate()
 }
 
+// redacted returns a copy of the config safe to log.
+func (cfg *loggerConfig) redacted() loggerConfig {
+	redacted := *cfg
+	redacted.ClientConfig = cfg.ClientConfig.redacted()
+	return redacted
+}
+
+// redactContainerDetails returns a copy of the container details safe to log,
+// with the values of the credential log options masked.
+func redactContainerDetails(containerDetails *ContainerDetails) *ContainerDetails {
+	if containerDetails == nil {
+		return nil
+	}
+	redacted := *containerDetails
+	redacted.Config = make(map[string]string, len(containerDetails.Config))
+	for k, v := range containerDetails.Config {
+		switch k {
+		case cfgSecretIDKey, cfgSecretKeyKey, cfgSecurityTokenKey, cfgInstanceInfoKey:
+			v = maskSecret(v)
+		case cfgProxyKey:
+			v = redactProxy(v)
+		}
+		redacted.Config[k] = v
+	}
+	return &redacted
+}
+
 func validateDriverOptions(opts map[string]string) error {
 	for opt := range opts {
 		switch opt {
 		case cfgEndpointKey,
+			cfgRegionKey,
 			cfgSecretIDKey,
 			cfgSecretKeyKey,
+			cfgSecurityTokenKey,
+			cfgSecretIDFileKey,
+			cfgSecretKeyFileKey,
 			cfgTopicIDKey,
 			cfgRetriesKey,
 			cfgTimeoutKey,
+			cfgRetryInitialIntervalKey,
+			cfgRetryMaxIntervalKey,
+			cfgCompressKey,
+			cfgBatchMaxBytesKey,
+			cfgBatchMaxMessagesKey,
+			cfgShareProducerKey,
+			cfgProxyKey,
+			cfgConfigFileKey,
+			cfgParseFormatKey,
+			cfgVerifyCredentialsKey,
+			cfgCloseTimeoutKey,
+			cfgEnqueueTimeoutKey,
 			cfgTemplateKey,
+			cfgTemplateMustBeJSONKey,
+			cfgMissingTagPolicyKey,
+			cfgFormatKey,
+			cfgTimestampFormatKey,
+			cfgTimestampTimezoneKey,
+			cfgJSONFieldsKey,
 			cfgFilterRegexKey,
+			cfgFilterModeKey,
+			cfgFilterCombineKey,
+			cfgLevelRegexKey,
+			cfgSampleRateKey,
+			cfgSampleKeepRegexKey,
+			cfgDedupWindowKey,
+			cfgPartialLogTimeoutKey,
+			cfgPartialLogInitialSizeKey,
+			cfgPartialLogMaxSizeKey,
+			cfgSendDeadlineKey,
+			cfgSendConcurrencyKey,
+			cfgInvalidUTF8Key,
+			cfgSchemaDescriptorIntervalKey,
+			cfgEnableIfEnvKey,
+			cfgStatsIntervalKey,
+			cfgThroughputIntervalKey,
+			cfgSpoolDirKey,
+			cfgSpoolMaxSizeKey,
+			cfgHealthcheckOnStartKey,
+			cfgDryRunKey,
+			cfgMetricsAddrKey,
 			cfgInstanceInfoKey,
-			cfgAppendContainerDetailsKeysKey:
-		case "max-file", "max-size", "compress", "labels", "labels-regex", "env", "env-regex", "tag", "mode":
+			cfgAppendContainerDetailsKeysKey,
+			cfgContainerDetailsModeKey,
+			cfgOrderingKey,
+			cfgAppendSourceKey,
+			cfgAppendK8sPodUIDKey,
+			cfgEmitBufferDepthKey,
+			cfgEmitIngestLatencyKey,
+			cfgEmitSizeBucketKey,
+			cfgFlattenJSONKey,
+			cfgIncludeRawKey,
+			cfgRawFieldNameKey,
+			cfgFieldPrefixKey,
+			cfgMaxFieldsKey,
+			cfgAppendHostnameKey,
+			cfgHostnameKey,
+			cfgStaticFieldsKey,
+			cfgEmitDockerTruncationKey,
+			cfgEmitLogModeKey,
+			cfgPartitionFieldKey,
+			cfgTimePrecisionKey,
+			cfgOutputSinkKey,
+			cfgOwnerLabelKey,
+			cfgTopicLabelKey,
+			cfgFanoutTopicsKey,
+			cfgRedactFieldsKey,
+			cfgCallerFieldsKey:
+		case "max-file", "max-size", "compress", "labels", "labels-regex", "env", "env-regex", "tag", cfgModeKey, "max-buffer-size":
 		case cfgNoFileKey, cfgKeepFileKey:
 		default:
 			return fmt.Errorf("unknown log opt '%s' for tencent cls log driver", opt)
@@ -111,24 +729,101 @@ func validateDriverOptions(opts map[string]string) error {
 	return nil
 }
 
-func parseClientConfig(containerDetails *ContainerDetails) (ClientConfig, error) {
+func parseClientConfig(logger *zap.Logger, containerDetails *ContainerDetails) (ClientConfig, error) {
 	var appendContainerDetailsKeys []string
 	if containerDetails.Config[cfgAppendContainerDetailsKeysKey] != "" {
 		appendContainerDetailsKeys = strings.Split(containerDetails.Config[cfgAppendContainerDetailsKeysKey], ",")
 	}
 
+	// The topics following the first one of topic_id are mirrored to like fanout-topics.
+	topicID, topicIDs, _ := strings.Cut(optionOrEnv(containerDetails.Config, cfgTopicIDKey, topicIDEnv), ",")
+	var fanoutTopics []string
+	if topicIDs != "" {
+		fanoutTopics = strings.Split(topicIDs, ",")
+	}
+	if containerDetails.Config[cfgFanoutTopicsKey] != "" {
+		fanoutTopics = append(fanoutTopics, strings.Split(containerDetails.Config[cfgFanoutTopicsKey], ",")...)
+	}
+
+	var redactFields []string
+	if containerDetails.Config[cfgRedactFieldsKey] != "" {
+		redactFields = strings.Split(containerDetails.Config[cfgRedactFieldsKey], ",")
+	}
+
+	var callerFields []string
+	if containerDetails.Config[cfgCallerFieldsKey] != "" {
+		callerFields = strings.Split(containerDetails.Config[cfgCallerFieldsKey], ",")
+	}
+
 	clientConfig := ClientConfig{
 		Endpoint:                   containerDetails.Config[cfgEndpointKey],
-		SecretID:                   containerDetails.Config[cfgSecretIDKey],
-		SecretKey:                  containerDetails.Config[cfgSecretKeyKey],
-		TopicID:                    containerDetails.Config[cfgTopicIDKey],
+		SecurityToken:              containerDetails.Config[cfgSecurityTokenKey],
+		TopicID:                    topicID,
 		InstanceInfo:               containerDetails.Config[cfgInstanceInfoKey],
+		OutputSink:                 containerDetails.Config[cfgOutputSinkKey],
+		OwnerLabel:                 containerDetails.Config[cfgOwnerLabelKey],
+		TopicLabel:                 containerDetails.Config[cfgTopicLabelKey],
+		FanoutTopics:               fanoutTopics,
+		RedactFields:               redactFields,
+		CallerFields:               callerFields,
+		Mode:                       containerDetails.Config[cfgModeKey],
+		Ordering:                   containerDetails.Config[cfgOrderingKey],
+		Compress:                   containerDetails.Config[cfgCompressKey],
+		PartitionField:             containerDetails.Config[cfgPartitionFieldKey],
+		TimePrecision:              containerDetails.Config[cfgTimePrecisionKey],
+		ParseFormat:                containerDetails.Config[cfgParseFormatKey],
+		Hostname:                   containerDetails.Config[cfgHostnameKey],
 		Retries:                    defaultClientConfig.Retries,
 		Timeout:                    defaultClientConfig.Timeout,
+		CloseTimeout:               defaultClientConfig.CloseTimeout,
+		MaxFields:                  defaultClientConfig.MaxFields,
 		AppendContainerDetailsKeys: appendContainerDetailsKeys,
+		ContainerDetailsMode:       containerDetails.Config[cfgContainerDetailsModeKey],
 		ContainerDetails:           containerDetails,
 	}
 
+	if scheme, host, ok := strings.Cut(clientConfig.Endpoint, "://"); ok && (scheme == "http" || scheme == "https") {
+		logger.Warn("endpoint must not include a scheme, stripping it",
+			zap.String("endpoint", clientConfig.Endpoint), zap.String("host", host))
+		clientConfig.Endpoint = strings.TrimSuffix(host, "/")
+	}
+
+	_, hasEndpoint := containerDetails.Config[cfgEndpointKey]
+	_, hasRegion := containerDetails.Config[cfgRegionKey]
+	if !hasEndpoint && !hasRegion {
+		clientConfig.Endpoint = os.Getenv(endpointEnv)
+	}
+
+	if region, ok := containerDetails.Config[cfgRegionKey]; ok {
+		if _, known := clsRegions[region]; !known {
+			return clientConfig, fmt.Errorf("unknown %q option: %s", cfgRegionKey, region)
+		}
+		if clientConfig.Endpoint != "" {
+			logger.Debug("both region and endpoint are set, using the endpoint",
+				zap.String("region", region), zap.String("endpoint", clientConfig.Endpoint))
+		} else {
+			clientConfig.Endpoint = region + ".cls.tencentcs.com"
+		}
+	}
+
+	if proxy, ok := containerDetails.Config[cfgProxyKey]; ok {
+		proxyURL, err := parseProxyURL(proxy)
+		if err != nil {
+			return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgProxyKey, err)
+		}
+		clientConfig.Proxy = proxyURL.String()
+	}
+
+	var err error
+	clientConfig.SecretID, clientConfig.SecretIDFile, err = parseSecret(logger, containerDetails.Config, cfgSecretIDKey, cfgSecretIDFileKey, secretIDEnv)
+	if err != nil {
+		return clientConfig, err
+	}
+	clientConfig.SecretKey, clientConfig.SecretKeyFile, err = parseSecret(logger, containerDetails.Config, cfgSecretKeyKey, cfgSecretKeyFileKey, secretKeyEnv)
+	if err != nil {
+		return clientConfig, err
+	}
+
 	if retries, ok := containerDetails.Config[cfgRetriesKey]; ok {
 		var err error
 		clientConfig.Retries, err = strconv.Atoi(retries)
@@ -140,6 +835,28 @@ func parseClientConfig(containerDetails *ContainerDetails) (ClientConfig, error)
 		}
 	}
 
+	for key, interval := range map[string]*time.Duration{
+		cfgRetryInitialIntervalKey: &clientConfig.RetryInitialInterval,
+		cfgRetryMaxIntervalKey:     &clientConfig.RetryMaxInterval,
+	} {
+		value, ok := containerDetails.Config[key]
+		if !ok {
+			continue
+		}
+		var err error
+		*interval, err = time.ParseDuration(value)
+		if err != nil {
+			return clientConfig, fmt.Errorf("failed to parse %q option: %w", key, err)
+		}
+		if *interval < time.Millisecond {
+			return clientConfig, fmt.Errorf("invalid %q option: %s", key, value)
+		}
+	}
+	if clientConfig.RetryInitialInterval > 0 && clientConfig.RetryMaxInterval > 0 &&
+		clientConfig.RetryInitialInterval > clientConfig.RetryMaxInterval {
+		return clientConfig, fmt.Errorf("%q option must not exceed %q option", cfgRetryInitialIntervalKey, cfgRetryMaxIntervalKey)
+	}
+
 	if timeout, ok := containerDetails.Config[cfgTimeoutKey]; ok {
 		var err error
 		clientConfig.Timeout, err = time.ParseDuration(timeout)
@@ -148,9 +865,248 @@ func parseClientConfig(containerDetails *ContainerDetails) (ClientConfig, error)
 		}
 	}
 
+	if closeTimeout, ok := containerDetails.Config[cfgCloseTimeoutKey]; ok {
+		clientConfig.CloseTimeout, err = time.ParseDuration(closeTimeout)
+		if err != nil {
+			return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgCloseTimeoutKey, err)
+		}
+		if clientConfig.CloseTimeout <= 0 {
+			return clientConfig, fmt.Errorf("invalid %q option: %s", cfgCloseTimeoutKey, closeTimeout)
+		}
+	}
+
+	if enqueueTimeout, ok := containerDetails.Config[cfgEnqueueTimeoutKey]; ok {
+		timeout, err := time.ParseDuration(enqueueTimeout)
+		if err != nil {
+			return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgEnqueueTimeoutKey, err)
+		}
+		if timeout < 0 {
+			return clientConfig, fmt.Errorf("invalid %q option: %s", cfgEnqueueTimeoutKey, enqueueTimeout)
+		}
+		clientConfig.EnqueueTimeout = &timeout
+	}
+
+	switch clientConfig.Mode {
+	case "", modeBlocking:
+	case modeNonBlocking:
+		if clientConfig.EnqueueTimeout != nil {
+			return clientConfig, fmt.Errorf("%q option can't be used with %s=%s, which never waits for buffer space", cfgEnqueueTimeoutKey, cfgModeKey, modeNonBlocking)
+		}
+	default:
+		return clientConfig, fmt.Errorf("invalid %q option: %s", cfgModeKey, clientConfig.Mode)
+	}
+
+	switch clientConfig.ContainerDetailsMode {
+	case "", containerDetailsModeFlat, containerDetailsModeNested:
+	default:
+		return clientConfig, fmt.Errorf("invalid %q option: %s", cfgContainerDetailsModeKey, clientConfig.ContainerDetailsMode)
+	}
+
+	if batchMaxBytes, ok := containerDetails.Config[cfgBatchMaxBytesKey]; ok {
+		clientConfig.BatchMaxBytes, err = units.RAMInBytes(batchMaxBytes)
+		if err != nil {
+			return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgBatchMaxBytesKey, err)
+		}
+		if clientConfig.BatchMaxBytes <= 0 || clientConfig.BatchMaxBytes > maxBatchBytes {
+			return clientConfig, fmt.Errorf("invalid %q option: %s", cfgBatchMaxBytesKey, batchMaxBytes)
+		}
+	}
+
+	if batchMaxMessages, ok := containerDetails.Config[cfgBatchMaxMessagesKey]; ok {
+		clientConfig.BatchMaxMessages, err = strconv.Atoi(batchMaxMessages)
+		if err != nil {
+			return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgBatchMaxMessagesKey, err)
+		}
+		if clientConfig.BatchMaxMessages <= 0 || clientConfig.BatchMaxMessages > maxBatchMessages {
+			return clientConfig, fmt.Errorf("invalid %q option: %s", cfgBatchMaxMessagesKey, batchMaxMessages)
+		}
+	}
+
+	clientConfig.ShareProducer, err = parseBool(containerDetails.Config[cfgShareProducerKey], false)
+	if err != nil {
+		return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgShareProducerKey, err)
+	}
+
+	clientConfig.VerifyCredentials, err = parseBool(containerDetails.Config[cfgVerifyCredentialsKey], false)
+	if err != nil {
+		return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgVerifyCredentialsKey, err)
+	}
+
+	switch clientConfig.PartitionField {
+	case "", partitionHour, partitionDay:
+	default:
+		return clientConfig, fmt.Errorf("invalid %q option: %s", cfgPartitionFieldKey, clientConfig.PartitionField)
+	}
+
+	switch clientConfig.ParseFormat {
+	case "", parseFormatJSON, parseFormatLogfmt, parseFormatNone:
+	default:
+		return clientConfig, fmt.Errorf("invalid %q option: %s", cfgParseFormatKey, clientConfig.ParseFormat)
+	}
+
+	switch clientConfig.TimePrecision {
+	case "", timePrecisionSecond, timePrecisionMillisecond:
+	default:
+		return clientConfig, fmt.Errorf("invalid %q option: %s", cfgTimePrecisionKey, clientConfig.TimePrecision)
+	}
+
+	if maxFields, ok := containerDetails.Config[cfgMaxFieldsKey]; ok {
+		clientConfig.MaxFields, err = strconv.Atoi(maxFields)
+		if err != nil {
+			return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgMaxFieldsKey, err)
+		}
+		if clientConfig.MaxFields < 0 {
+			return clientConfig, fmt.Errorf("invalid %q option: %s", cfgMaxFieldsKey, maxFields)
+		}
+	}
+
+	// The field prefix is parsed before the static fields, whose reserved names depend on it.
+	if fieldPrefix := containerDetails.Config[cfgFieldPrefixKey]; fieldPrefix != "" {
+		clientConfig.FieldPrefix = fieldPrefix
+		// The longest field added by the driver, as the names are limited in length.
+		if !clsFieldNameRegexp.MatchString(clientConfig.reservedField("container_details")) {
+			return clientConfig, fmt.Errorf("invalid %q option: %q", cfgFieldPrefixKey, fieldPrefix)
+		}
+	}
+
+	if staticFields := containerDetails.Config[cfgStaticFieldsKey]; staticFields != "" {
+		clientConfig.StaticFields = map[string]string{}
+		for _, pair := range strings.Split(staticFields, ",") {
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok || k == "" {
+				return clientConfig, fmt.Errorf("invalid %q option: %q is not a key=value pair", cfgStaticFieldsKey, pair)
+			}
+			if clientConfig.isReservedField(k) {
+				logger.Warn("skipping static field with a reserved name", zap.String("field", k))
+				continue
+			}
+			clientConfig.StaticFields[k] = v
+		}
+	}
+
+	if rawFieldName, ok := containerDetails.Config[cfgRawFieldNameKey]; ok {
+		if !clsFieldNameRegexp.MatchString(rawFieldName) {
+			return clientConfig, fmt.Errorf("invalid %q option: %q", cfgRawFieldNameKey, rawFieldName)
+		}
+		clientConfig.RawFieldName = rawFieldName
+	}
+
+	switch clientConfig.Compress {
+	case "", compressLZ4, compressZstd:
+	default:
+		return clientConfig, fmt.Errorf("invalid %q option: %s", cfgCompressKey, clientConfig.Compress)
+	}
+
+	switch clientConfig.Ordering {
+	case "", orderingNone:
+	case orderingPerContainer:
+		if clientConfig.ShareProducer {
+			return clientConfig, fmt.Errorf("%q option can't be used with %s=%s, as the shared producer uploads the logs of other containers too", cfgShareProducerKey, cfgOrderingKey, orderingPerContainer)
+		}
+	default:
+		return clientConfig, fmt.Errorf("invalid %q option: %s", cfgOrderingKey, clientConfig.Ordering)
+	}
+
+	clientConfig.AppendSource, err = parseBool(containerDetails.Config[cfgAppendSourceKey], false)
+	if err != nil {
+		return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgAppendSourceKey, err)
+	}
+	clientConfig.AppendK8sPodUID, err = parseBool(containerDetails.Config[cfgAppendK8sPodUIDKey], false)
+	if err != nil {
+		return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgAppendK8sPodUIDKey, err)
+	}
+	clientConfig.EmitBufferDepth, err = parseBool(containerDetails.Config[cfgEmitBufferDepthKey], false)
+	if err != nil {
+		return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgEmitBufferDepthKey, err)
+	}
+	clientConfig.EmitIngestLatency, err = parseBool(containerDetails.Config[cfgEmitIngestLatencyKey], false)
+	if err != nil {
+		return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgEmitIngestLatencyKey, err)
+	}
+	clientConfig.EmitSizeBucket, err = parseBool(containerDetails.Config[cfgEmitSizeBucketKey], false)
+	if err != nil {
+		return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgEmitSizeBucketKey, err)
+	}
+	clientConfig.EmitDockerTruncation, err = parseBool(containerDetails.Config[cfgEmitDockerTruncationKey], false)
+	if err != nil {
+		return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgEmitDockerTruncationKey, err)
+	}
+	clientConfig.EmitLogMode, err = parseBool(containerDetails.Config[cfgEmitLogModeKey], false)
+	if err != nil {
+		return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgEmitLogModeKey, err)
+	}
+	appendHostname, err := parseBool(containerDetails.Config[cfgAppendHostnameKey], true)
+	if err != nil {
+		return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgAppendHostnameKey, err)
+	}
+	clientConfig.OmitHostname = !appendHostname
+	clientConfig.FlattenJSON, err = parseBool(containerDetails.Config[cfgFlattenJSONKey], false)
+	if err != nil {
+		return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgFlattenJSONKey, err)
+	}
+
+	clientConfig.IncludeRaw, err = parseBool(containerDetails.Config[cfgIncludeRawKey], false)
+	if err != nil {
+		return clientConfig, fmt.Errorf("failed to parse %q option: %w", cfgIncludeRawKey, err)
+	}
+
 	return clientConfig, nil
 }
 
+// parseSecret returns the credential set by the inline option or read from the file option,
+// preferring the file when both are set, or the env var when neither is.
+func parseSecret(logger *zap.Logger, opts map[string]string, key, fileKey, env string) (value, file string, err error) {
+	file, ok := opts[fileKey]
+	if !ok {
+		return optionOrEnv(opts, key, env), "", nil
+	}
+	if opts[key] != "" {
+		logger.Warn("both inline and file credentials are set, using the file",
+			zap.String("option", key), zap.String("file_option", fileKey))
+	}
+
+	value, err = readSecretFile(file)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read %q option: %w", fileKey, err)
+	}
+	return value, file, nil
+}
+
+// optionOrEnv returns the option, or the env var of the plugin when the option is absent.
+func optionOrEnv(opts map[string]string, key, env string) string {
+	if value, ok := opts[key]; ok {
+		return value
+	}
+	return os.Getenv(env)
+}
+
+// readConfigFile reads the options from a JSON or YAML file mapping
+// the option names to their values.
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// YAML is a superset of JSON, so both are parsed the same way.
+	opts := map[string]string{}
+	if err := yaml.Unmarshal(b, &opts); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if _, ok := opts[cfgConfigFileKey]; ok {
+		return nil, fmt.Errorf("%s can't set the %q option", path, cfgConfigFileKey)
+	}
+	return opts, nil
+}
+
+// readSecretFile reads a credential from the file, trimming trailing whitespace.
+func readSecretFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), " \t\r\n"), nil
+}
+
 func parseBool(value string, defaultValue bool) (bool, error) {
 	if value == "" {
 		return defaultValue, nil
@@ -0,0 +1,857 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"go.uber.org/zap"
+)
+
+func TestParseClientConfigSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		return path
+	}
+	idFile := writeFile("id", "file-id\n")
+	keyFile := writeFile("key", "file-key \r\n")
+	emptyFile := writeFile("empty", "\n")
+
+	cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{
+		cfgSecretIDKey:      "inline-id",
+		cfgSecretIDFileKey:  idFile,
+		cfgSecretKeyFileKey: keyFile,
+	}})
+	if err != nil {
+		t.Fatalf("failed to parse client config: %v", err)
+	}
+	if cfg.SecretID != "file-id" || cfg.SecretKey != "file-key" {
+		t.Fatalf("expected credentials from files, got %q and %q", cfg.SecretID, cfg.SecretKey)
+	}
+
+	_, err = parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{
+		cfgSecretIDFileKey: filepath.Join(dir, "missing"),
+	}})
+	if err == nil || !strings.Contains(err.Error(), cfgSecretIDFileKey) {
+		t.Fatalf("expected error for missing file, got %v", err)
+	}
+
+	cfg, err = parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{
+		cfgSecretKeyFileKey: emptyFile,
+	}})
+	if err != nil {
+		t.Fatalf("failed to parse client config: %v", err)
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "secret key file") {
+		t.Fatalf("expected error for empty secret key file, got %v", err)
+	}
+}
+
+func TestParseClientConfigEnvFallback(t *testing.T) {
+	t.Setenv(endpointEnv, "env.cls.tencentcs.com")
+	t.Setenv(secretIDEnv, "env-id")
+	t.Setenv(secretKeyEnv, "env-key")
+	t.Setenv(topicIDEnv, "env-topic")
+
+	cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{}})
+	if err != nil {
+		t.Fatalf("failed to parse client config: %v", err)
+	}
+	want := ClientConfig{Endpoint: "env.cls.tencentcs.com", SecretID: "env-id", SecretKey: "env-key", TopicID: "env-topic"}
+	if cfg.Endpoint != want.Endpoint || cfg.SecretID != want.SecretID || cfg.SecretKey != want.SecretKey || cfg.TopicID != want.TopicID {
+		t.Fatalf("expected credentials from env, got %s", cfg)
+	}
+
+	cfg, err = parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{
+		cfgEndpointKey:  "opt.cls.tencentcs.com",
+		cfgSecretIDKey:  "opt-id",
+		cfgSecretKeyKey: "opt-key",
+		cfgTopicIDKey:   "opt-topic",
+	}})
+	if err != nil {
+		t.Fatalf("failed to parse client config: %v", err)
+	}
+	if cfg.Endpoint != "opt.cls.tencentcs.com" || cfg.SecretID != "opt-id" || cfg.SecretKey != "opt-key" || cfg.TopicID != "opt-topic" {
+		t.Fatalf("expected options to override env, got %s", cfg)
+	}
+
+	cfg, err = parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{
+		cfgRegionKey: "ap-shanghai",
+	}})
+	if err != nil {
+		t.Fatalf("failed to parse client config: %v", err)
+	}
+	if cfg.Endpoint != "ap-shanghai.cls.tencentcs.com" {
+		t.Fatalf("expected region to override env endpoint, got %q", cfg.Endpoint)
+	}
+}
+
+func TestParseClientConfigRegion(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    map[string]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "region",
+			opts: map[string]string{cfgRegionKey: "ap-guangzhou"},
+			want: "ap-guangzhou.cls.tencentcs.com",
+		},
+		{
+			name: "endpoint wins",
+			opts: map[string]string{cfgRegionKey: "ap-guangzhou", cfgEndpointKey: "ap-shanghai.cls.tencentcs.com"},
+			want: "ap-shanghai.cls.tencentcs.com",
+		},
+		{
+			name: "endpoint scheme stripped",
+			opts: map[string]string{cfgEndpointKey: "https://ap-shanghai.cls.tencentcs.com/"},
+			want: "ap-shanghai.cls.tencentcs.com",
+		},
+		{
+			name:    "unknown region",
+			opts:    map[string]string{cfgRegionKey: "ap-atlantis"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: tt.opts})
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), cfgRegionKey) {
+					t.Fatalf("expected region error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse client config: %v", err)
+			}
+			if cfg.Endpoint != tt.want {
+				t.Fatalf("expected endpoint %q, got %q", tt.want, cfg.Endpoint)
+			}
+		})
+	}
+}
+
+func TestParseClientConfigProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    map[string]string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", opts: map[string]string{}, want: ""},
+		{name: "url", opts: map[string]string{cfgProxyKey: "http://proxy.internal:3128"}, want: "http://proxy.internal:3128"},
+		{name: "missing scheme", opts: map[string]string{cfgProxyKey: "proxy.internal:3128"}, want: "http://proxy.internal:3128"},
+		{name: "unsupported scheme", opts: map[string]string{cfgProxyKey: "ftp://proxy.internal:3128"}, wantErr: true},
+		{name: "missing host", opts: map[string]string{cfgProxyKey: "http://"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: tt.opts})
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), cfgProxyKey) {
+					t.Fatalf("expected proxy error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse client config: %v", err)
+			}
+			if cfg.Proxy != tt.want {
+				t.Fatalf("expected proxy %q, got %q", tt.want, cfg.Proxy)
+			}
+		})
+	}
+}
+
+func TestParseClientConfigMode(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         map[string]string
+		wantErr      bool
+		wantBlockSec int
+	}{
+		{name: "default", opts: map[string]string{}, wantBlockSec: 60},
+		{name: "blocking", opts: map[string]string{cfgModeKey: modeBlocking}, wantBlockSec: -1},
+		{name: "blocking with timeout", opts: map[string]string{cfgModeKey: modeBlocking, cfgEnqueueTimeoutKey: "5s"}, wantBlockSec: 5},
+		{name: "non-blocking", opts: map[string]string{cfgModeKey: modeNonBlocking}, wantBlockSec: 0},
+		{name: "non-blocking with timeout", opts: map[string]string{cfgModeKey: modeNonBlocking, cfgEnqueueTimeoutKey: "5s"}, wantErr: true},
+		{name: "invalid", opts: map[string]string{cfgModeKey: "sometimes"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: tt.opts})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse client config: %v", err)
+			}
+			if got := newProducerConfig(cfg).MaxBlockSec; got != tt.wantBlockSec {
+				t.Fatalf("expected MaxBlockSec %d, got %d", tt.wantBlockSec, got)
+			}
+		})
+	}
+}
+
+func TestParseLoggerConfigFilterRegex(t *testing.T) {
+	opts := map[string]string{
+		cfgEndpointKey:    "ap-guangzhou.cls.tencentcs.com",
+		cfgSecretIDKey:    "id",
+		cfgSecretKeyKey:   "key",
+		cfgTopicIDKey:     "topic",
+		cfgFilterRegexKey: "a{1,3}",
+	}
+
+	cfg, err := parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: opts})
+	if err != nil {
+		t.Fatalf("failed to parse logger config: %v", err)
+	}
+	if len(cfg.FilterRegexes) != 1 || cfg.FilterRegexes[0].String() != "a{1,3}" {
+		t.Fatalf("expected a single pattern, got %v", cfg.FilterRegexes)
+	}
+
+	opts[cfgFilterRegexKey] = "error\nwarn"
+	cfg, err = parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: opts})
+	if err != nil {
+		t.Fatalf("failed to parse logger config: %v", err)
+	}
+	if len(cfg.FilterRegexes) != 2 {
+		t.Fatalf("expected 2 patterns, got %v", cfg.FilterRegexes)
+	}
+
+	opts[cfgFilterRegexKey] = "error\n(unclosed"
+	_, err = parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: opts})
+	if err == nil || !strings.Contains(err.Error(), "(unclosed") {
+		t.Fatalf("expected error naming the malformed pattern, got %v", err)
+	}
+}
+
+func TestParseLoggerConfigConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{
+			name: "json",
+			file: "config.json",
+			content: `{"endpoint": "ap-guangzhou.cls.tencentcs.com", "secret_id": "file-id", "secret_key": "key",
+				"topic_id": "file-topic", "retries": 5, "dry-run": true}`,
+		},
+		{
+			name: "yaml",
+			file: "config.yaml",
+			content: `endpoint: ap-guangzhou.cls.tencentcs.com
+secret_id: file-id
+secret_key: key
+topic_id: file-topic
+retries: 5
+dry-run: true
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatalf("failed to write config file: %v", err)
+			}
+
+			cfg, err := parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{
+				cfgConfigFileKey: path,
+				cfgTopicIDKey:    "inline-topic",
+			}})
+			if err != nil {
+				t.Fatalf("failed to parse logger config: %v", err)
+			}
+			if cfg.ClientConfig.TopicID != "inline-topic" {
+				t.Errorf("expected the inline topic to take precedence, got %q", cfg.ClientConfig.TopicID)
+			}
+			if cfg.ClientConfig.SecretID != "file-id" || cfg.ClientConfig.Retries != 5 || !cfg.DryRun {
+				t.Errorf("expected the options from the file, got %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestParseLoggerConfigConfigFileInvalid(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "unknown option", content: "endpoint: ap-guangzhou.cls.tencentcs.com\nsecret_id: id\nsecret_key: key\ntopic_id: topic\nnope: 1\n", wantErr: "nope"},
+		{name: "nested config file", content: "config-file: other.yaml\n", wantErr: cfgConfigFileKey},
+		{name: "not a map", content: "- endpoint\n", wantErr: "failed to parse"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("config-%d.yaml", i))
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatalf("failed to write config file: %v", err)
+			}
+			_, err := parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{cfgConfigFileKey: path}})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	_, err := parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{cfgConfigFileKey: filepath.Join(dir, "missing.yaml")}})
+	if err == nil {
+		t.Fatal("expected error for missing config file")
+	}
+}
+
+func TestParseLoggerConfigSampling(t *testing.T) {
+	opts := map[string]string{
+		cfgEndpointKey:  "ap-guangzhou.cls.tencentcs.com",
+		cfgSecretIDKey:  "id",
+		cfgSecretKeyKey: "key",
+		cfgTopicIDKey:   "topic",
+	}
+	cfg, err := parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: opts})
+	if err != nil {
+		t.Fatalf("failed to parse logger config: %v", err)
+	}
+	if cfg.SampleRate != 1 || cfg.SampleKeepRegex != nil {
+		t.Fatalf("expected no sampling by default, got rate %v and keep regex %v", cfg.SampleRate, cfg.SampleKeepRegex)
+	}
+
+	opts[cfgSampleRateKey] = "0.1"
+	opts[cfgSampleKeepRegexKey] = "ERROR|WARN"
+	cfg, err = parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: opts})
+	if err != nil {
+		t.Fatalf("failed to parse logger config: %v", err)
+	}
+	if cfg.SampleRate != 0.1 || cfg.SampleKeepRegex.String() != "ERROR|WARN" {
+		t.Fatalf("expected rate 0.1 and keep regex, got rate %v and keep regex %v", cfg.SampleRate, cfg.SampleKeepRegex)
+	}
+
+	for _, invalid := range []map[string]string{
+		{cfgSampleRateKey: "1.5"},
+		{cfgSampleRateKey: "-0.1"},
+		{cfgSampleRateKey: "half"},
+		{cfgSampleKeepRegexKey: "(unclosed"},
+	} {
+		maps.Copy(opts, invalid)
+		if _, err := parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: opts}); err == nil {
+			t.Errorf("expected error for %v", invalid)
+		}
+		opts[cfgSampleRateKey] = "0.1"
+		opts[cfgSampleKeepRegexKey] = "ERROR|WARN"
+	}
+}
+
+func TestParseLoggerConfigMetricsAddr(t *testing.T) {
+	opts := map[string]string{
+		cfgEndpointKey:    "ap-guangzhou.cls.tencentcs.com",
+		cfgSecretIDKey:    "id",
+		cfgSecretKeyKey:   "key",
+		cfgTopicIDKey:     "topic",
+		cfgMetricsAddrKey: ":9100",
+	}
+
+	cfg, err := parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: opts})
+	if err != nil {
+		t.Fatalf("failed to parse logger config: %v", err)
+	}
+	if cfg.MetricsAddr != ":9100" {
+		t.Fatalf("expected metrics addr :9100, got %q", cfg.MetricsAddr)
+	}
+
+	opts[cfgMetricsAddrKey] = "9100"
+	if _, err := parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: opts}); err == nil {
+		t.Fatal("expected error for metrics addr without port")
+	}
+}
+
+func TestParseLoggerConfigSendConcurrency(t *testing.T) {
+	opts := map[string]string{
+		cfgEndpointKey:        "ap-guangzhou.cls.tencentcs.com",
+		cfgSecretIDKey:        "id",
+		cfgSecretKeyKey:       "key",
+		cfgTopicIDKey:         "topic",
+		cfgSendConcurrencyKey: "8",
+	}
+
+	cfg, err := parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: opts})
+	if err != nil {
+		t.Fatalf("failed to parse logger config: %v", err)
+	}
+	if cfg.SendConcurrency != 8 {
+		t.Fatalf("expected send concurrency 8, got %d", cfg.SendConcurrency)
+	}
+
+	for _, invalid := range []string{"-1", "many"} {
+		opts[cfgSendConcurrencyKey] = invalid
+		if _, err := parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: opts}); err == nil {
+			t.Errorf("expected error for send concurrency %q", invalid)
+		}
+	}
+
+	// A single worker keeps the order of the logs.
+	opts[cfgOrderingKey] = orderingPerContainer
+	opts[cfgSendConcurrencyKey] = "1"
+	if _, err := parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: opts}); err != nil {
+		t.Fatalf("failed to parse logger config: %v", err)
+	}
+	opts[cfgSendConcurrencyKey] = "8"
+	if _, err := parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: opts}); err == nil || !strings.Contains(err.Error(), cfgOrderingKey) {
+		t.Fatalf("expected error for send concurrency with per-container ordering, got %v", err)
+	}
+}
+
+func TestParseLoggerConfigInvalidUTF8(t *testing.T) {
+	opts := map[string]string{
+		cfgEndpointKey:  "ap-guangzhou.cls.tencentcs.com",
+		cfgSecretIDKey:  "id",
+		cfgSecretKeyKey: "key",
+		cfgTopicIDKey:   "topic",
+	}
+
+	cfg, err := parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: opts})
+	if err != nil {
+		t.Fatalf("failed to parse logger config: %v", err)
+	}
+	if cfg.InvalidUTF8 != invalidUTF8Raw {
+		t.Fatalf("expected invalid UTF-8 to be sent as is by default, got %q", cfg.InvalidUTF8)
+	}
+
+	opts[cfgInvalidUTF8Key] = invalidUTF8Replace
+	if cfg, err = parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: opts}); err != nil {
+		t.Fatalf("failed to parse logger config: %v", err)
+	}
+	if cfg.InvalidUTF8 != invalidUTF8Replace {
+		t.Fatalf("expected invalid UTF-8 %q, got %q", invalidUTF8Replace, cfg.InvalidUTF8)
+	}
+
+	opts[cfgInvalidUTF8Key] = "escape"
+	if _, err := parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: opts}); err == nil {
+		t.Fatal("expected error for invalid invalid-utf8 option")
+	}
+}
+
+func TestParseLoggerConfigExtraAttributes(t *testing.T) {
+	opts := map[string]string{
+		cfgEndpointKey:  "ap-guangzhou.cls.tencentcs.com",
+		cfgSecretIDKey:  "id",
+		cfgSecretKeyKey: "key",
+		cfgTopicIDKey:   "topic",
+		"labels":        "team",
+		"labels-regex":  "^com\\.example\\.",
+		"env":           "REGION",
+		"env-regex":     "^APP_",
+	}
+	containerDetails := &ContainerDetails{
+		Config: opts,
+		ContainerLabels: map[string]string{
+			"team":                "infra",
+			"com.example.service": "api",
+			"com.other.service":   "web",
+		},
+		ContainerEnv: []string{"REGION=cn-1", "APP_NAME=api", "APP_VERSION=1.2", "HOME=/root"},
+	}
+
+	cfg, err := parseLoggerConfig(zap.NewNop(), containerDetails)
+	if err != nil {
+		t.Fatalf("failed to parse logger config: %v", err)
+	}
+	want := map[string]string{
+		"team":                "infra",
+		"com.example.service": "api",
+		"REGION":              "cn-1",
+		"APP_NAME":            "api",
+		"APP_VERSION":         "1.2",
+	}
+	if !maps.Equal(cfg.Attrs, want) {
+		t.Fatalf("expected attrs %v, got %v", want, cfg.Attrs)
+	}
+
+	opts["env-regex"] = "(unclosed"
+	if _, err := parseLoggerConfig(zap.NewNop(), containerDetails); err == nil {
+		t.Fatal("expected error for invalid env-regex")
+	}
+}
+
+func TestParseLoggerConfigTimestamp(t *testing.T) {
+	opts := map[string]string{
+		cfgEndpointKey:          "ap-guangzhou.cls.tencentcs.com",
+		cfgSecretIDKey:          "id",
+		cfgSecretKeyKey:         "key",
+		cfgTopicIDKey:           "topic",
+		cfgTemplateKey:          "{timestamp} {log}",
+		cfgTimestampFormatKey:   "2006-01-02 15:04:05",
+		cfgTimestampTimezoneKey: "Asia/Shanghai",
+	}
+	details := &ContainerDetails{Config: opts}
+
+	cfg, err := parseLoggerConfig(zap.NewNop(), details)
+	if err != nil {
+		t.Fatalf("failed to parse logger config: %v", err)
+	}
+	formatter, err := newMessageFormatter(details, cfg)
+	if err != nil {
+		t.Fatalf("failed to create message formatter: %v", err)
+	}
+
+	msg := &logger.Message{Line: []byte("line"), Timestamp: time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC)}
+	if got, want := formatter.Format(msg), "2024-06-01 21:00:00 line"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	opts[cfgTimestampTimezoneKey] = "Mars/Olympus_Mons"
+	if _, err := parseLoggerConfig(zap.NewNop(), details); err == nil || !strings.Contains(err.Error(), cfgTimestampTimezoneKey) {
+		t.Fatalf("expected invalid timezone error, got %v", err)
+	}
+}
+
+func TestParseClientConfigOrdering(t *testing.T) {
+	cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{cfgOrderingKey: orderingPerContainer}})
+	if err != nil {
+		t.Fatalf("failed to parse client config: %v", err)
+	}
+	if cfg.Ordering != orderingPerContainer {
+		t.Fatalf("expected ordering %q, got %q", orderingPerContainer, cfg.Ordering)
+	}
+
+	if _, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{cfgOrderingKey: "global"}}); err == nil {
+		t.Fatal("expected error for invalid ordering")
+	}
+
+	opts := map[string]string{cfgOrderingKey: orderingPerContainer, cfgShareProducerKey: "true"}
+	if _, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: opts}); err == nil || !strings.Contains(err.Error(), cfgShareProducerKey) {
+		t.Fatalf("expected error for per-container ordering with a shared producer, got %v", err)
+	}
+}
+
+func TestParseClientConfigTimePrecision(t *testing.T) {
+	cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{cfgTimePrecisionKey: timePrecisionMillisecond}})
+	if err != nil {
+		t.Fatalf("failed to parse client config: %v", err)
+	}
+	if cfg.TimePrecision != timePrecisionMillisecond {
+		t.Fatalf("expected time precision %q, got %q", timePrecisionMillisecond, cfg.TimePrecision)
+	}
+
+	if _, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{cfgTimePrecisionKey: "us"}}); err == nil {
+		t.Fatal("expected error for invalid time precision")
+	}
+}
+
+func TestParseClientConfigFieldPrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		wantErr bool
+	}{
+		{prefix: "cls_"},
+		{prefix: "x"},
+		{prefix: "cls prefix", wantErr: true},
+		{prefix: "cls:", wantErr: true},
+		{prefix: strings.Repeat("x", 256), wantErr: true},
+	}
+	for _, tt := range tests {
+		cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{cfgFieldPrefixKey: tt.prefix}})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("prefix %q: expected error", tt.prefix)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("prefix %q: unexpected error: %v", tt.prefix, err)
+			continue
+		}
+		if got := cfg.reservedField("hostname"); got != tt.prefix+"hostname__" {
+			t.Errorf("prefix %q: expected hostname field %q, got %q", tt.prefix, tt.prefix+"hostname__", got)
+		}
+	}
+}
+
+func TestParseClientConfigParseFormat(t *testing.T) {
+	cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{cfgParseFormatKey: parseFormatLogfmt}})
+	if err != nil {
+		t.Fatalf("failed to parse client config: %v", err)
+	}
+	if cfg.ParseFormat != parseFormatLogfmt {
+		t.Fatalf("expected parse format %q, got %q", parseFormatLogfmt, cfg.ParseFormat)
+	}
+
+	if _, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{cfgParseFormatKey: "xml"}}); err == nil {
+		t.Fatal("expected error for invalid parse format")
+	}
+}
+
+func TestParseLoggerConfigEnableIfEnv(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          []string
+		wantDisabled bool
+	}{
+		{name: "enabled", env: []string{"SHIP_LOGS=true"}, wantDisabled: false},
+		{name: "disabled", env: []string{"SHIP_LOGS=0"}, wantDisabled: true},
+		{name: "invalid", env: []string{"SHIP_LOGS=maybe"}, wantDisabled: true},
+		{name: "absent", env: []string{"SHIP_LOGS_OLD=true"}, wantDisabled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			details := &ContainerDetails{
+				Config: map[string]string{
+					cfgEndpointKey:    "ap-guangzhou.cls.tencentcs.com",
+					cfgSecretIDKey:    "id",
+					cfgSecretKeyKey:   "key",
+					cfgTopicIDKey:     "topic",
+					cfgEnableIfEnvKey: "SHIP_LOGS",
+				},
+				ContainerEnv: tt.env,
+			}
+			cfg, err := parseLoggerConfig(zap.NewNop(), details)
+			if err != nil {
+				t.Fatalf("failed to parse logger config: %v", err)
+			}
+			if cfg.Disabled != tt.wantDisabled {
+				t.Fatalf("expected disabled %v, got %v", tt.wantDisabled, cfg.Disabled)
+			}
+		})
+	}
+}
+
+func TestParseClientConfigRetryIntervals(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       map[string]string
+		wantErr    bool
+		wantBaseMs int64
+		wantMaxMs  int64
+	}{
+		{name: "default", opts: map[string]string{}, wantBaseMs: 100, wantMaxMs: 50000},
+		{name: "custom", opts: map[string]string{cfgRetryInitialIntervalKey: "500ms", cfgRetryMaxIntervalKey: "10s"}, wantBaseMs: 500, wantMaxMs: 10000},
+		{name: "initial above max", opts: map[string]string{cfgRetryInitialIntervalKey: "1m", cfgRetryMaxIntervalKey: "10s"}, wantErr: true},
+		{name: "invalid", opts: map[string]string{cfgRetryMaxIntervalKey: "0s"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: tt.opts})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse client config: %v", err)
+			}
+			producerConfig := newProducerConfig(cfg)
+			if producerConfig.BaseRetryBackoffMs != tt.wantBaseMs || producerConfig.MaxRetryBackoffMs != tt.wantMaxMs {
+				t.Fatalf("expected backoff %dms to %dms, got %dms to %dms",
+					tt.wantBaseMs, tt.wantMaxMs, producerConfig.BaseRetryBackoffMs, producerConfig.MaxRetryBackoffMs)
+			}
+		})
+	}
+}
+
+func TestParseClientConfigCompress(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    map[string]string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", opts: map[string]string{}, want: ""},
+		{name: "zstd", opts: map[string]string{cfgCompressKey: compressZstd}, want: compressZstd},
+		{name: "docker compress is not cls compress", opts: map[string]string{"compress": "true"}, want: ""},
+		{name: "gzip", opts: map[string]string{cfgCompressKey: "gzip"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: tt.opts})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse client config: %v", err)
+			}
+			if got := newProducerConfig(cfg).CompressType; got != tt.want {
+				t.Fatalf("expected compress type %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseClientConfigBatchMaxBytes(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    map[string]string
+		want    int64
+		wantErr bool
+	}{
+		{name: "default", opts: map[string]string{}, want: 512 << 10},
+		{name: "custom", opts: map[string]string{cfgBatchMaxBytesKey: "1m"}, want: 1 << 20},
+		{name: "above request limit", opts: map[string]string{cfgBatchMaxBytesKey: "6m"}, wantErr: true},
+		{name: "invalid", opts: map[string]string{cfgBatchMaxBytesKey: "lots"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: tt.opts})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse client config: %v", err)
+			}
+			if got := newProducerConfig(cfg).MaxBatchSize; got != tt.want {
+				t.Fatalf("expected MaxBatchSize %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseClientConfigBatchMaxMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    map[string]string
+		want    int
+		wantErr bool
+	}{
+		{name: "default", opts: map[string]string{}, want: 4096},
+		{name: "custom", opts: map[string]string{cfgBatchMaxMessagesKey: "100"}, want: 100},
+		{name: "above producer limit", opts: map[string]string{cfgBatchMaxMessagesKey: "50000"}, wantErr: true},
+		{name: "zero", opts: map[string]string{cfgBatchMaxMessagesKey: "0"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: tt.opts})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse client config: %v", err)
+			}
+			if got := newProducerConfig(cfg).MaxBatchCount; got != tt.want {
+				t.Fatalf("expected MaxBatchCount %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseLoggerConfigLevelRegex(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{name: "capture group", value: `level=(\w+)`},
+		{name: "no capture group", value: `level=\w+`, wantErr: true},
+		{name: "invalid", value: `level=(`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseLoggerConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{
+				cfgEndpointKey:   "ap-guangzhou.cls.tencentcs.com",
+				cfgTopicIDKey:    "topic",
+				cfgSecretIDKey:   "id",
+				cfgSecretKeyKey:  "key",
+				cfgLevelRegexKey: tt.value,
+			}})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse logger config: %v", err)
+			}
+			if cfg.LevelRegex.String() != tt.value {
+				t.Fatalf("expected level regex %q, got %q", tt.value, cfg.LevelRegex)
+			}
+		})
+	}
+}
+
+func TestParseClientConfigRawFieldName(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{name: "message", value: "message"},
+		{name: "dotted", value: "app.log"},
+		{name: "empty", value: "", wantErr: true},
+		{name: "space", value: "raw log", wantErr: true},
+		{name: "leading dash", value: "-log", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: map[string]string{
+				cfgRawFieldNameKey: tt.value,
+			}})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse client config: %v", err)
+			}
+			if cfg.RawFieldName != tt.value {
+				t.Fatalf("expected raw field name %q, got %q", tt.value, cfg.RawFieldName)
+			}
+		})
+	}
+}
+
+func TestParseClientConfigAppendHostname(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     map[string]string
+		wantOmit bool
+		wantErr  bool
+	}{
+		{name: "default", opts: map[string]string{}},
+		{name: "disabled", opts: map[string]string{cfgAppendHostnameKey: "false"}, wantOmit: true},
+		{name: "invalid", opts: map[string]string{cfgAppendHostnameKey: "maybe"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseClientConfig(zap.NewNop(), &ContainerDetails{Config: tt.opts})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse client config: %v", err)
+			}
+			if cfg.OmitHostname != tt.wantOmit {
+				t.Fatalf("expected OmitHostname %t, got %t", tt.wantOmit, cfg.OmitHostname)
+			}
+		})
+	}
+}
@@ -0,0 +1,1701 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/backend"
+	"github.com/docker/docker/daemon/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type fakeClient struct {
+	mu       sync.Mutex
+	messages []string
+	sent     []logMessage
+	closed   bool
+	flushed  bool
+	// closeTimeout is the timeout Close was called with.
+	closeTimeout time.Duration
+	// err is returned from SendMessage when set.
+	err error
+	// stats is returned from Stats.
+	stats ClientStats
+	// unhealthy is returned from HealthCheck.
+	unhealthy error
+	// block blocks SendMessageCtx until closed or the context is done, if set.
+	block chan struct{}
+}
+
+func (c *fakeClient) SendMessage(message logMessage) error {
+	return c.SendMessageCtx(context.Background(), message)
+}
+
+func (c *fakeClient) SendMessageCtx(ctx context.Context, message logMessage) error {
+	if c.block != nil {
+		select {
+		case <-c.block:
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", errSendAbandoned, ctx.Err())
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.messages = append(c.messages, message.Text)
+	c.sent = append(c.sent, message)
+	return nil
+}
+
+func (c *fakeClient) FieldNames() []string {
+	return []string{"__hostname__"}
+}
+
+func (c *fakeClient) Stats() ClientStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *fakeClient) HealthCheck(context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.unhealthy
+}
+
+func (c *fakeClient) Flush(context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushed = true
+	return nil
+}
+
+func (c *fakeClient) Close(timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.closeTimeout = timeout
+	return nil
+}
+
+func newTestLogger(t *testing.T, cfg loggerConfig, client client) *TencentCLSLogger {
+	t.Helper()
+
+	if cfg.Template == "" {
+		cfg.Template = defaultLoggerConfig.Template
+	}
+	if cfg.PartialLogInitialSize == 0 {
+		cfg.PartialLogInitialSize = defaultLoggerConfig.PartialLogInitialSize
+	}
+	if cfg.SampleRate == 0 {
+		cfg.SampleRate = defaultLoggerConfig.SampleRate
+	}
+	formatter, err := newMessageFormatter(&ContainerDetails{}, &cfg)
+	if err != nil {
+		t.Fatalf("failed to create message formatter: %v", err)
+	}
+
+	sendCtx, cancelSends := context.WithCancel(context.Background())
+	return &TencentCLSLogger{
+		sendCtx:           sendCtx,
+		cancelSends:       cancelSends,
+		client:            client,
+		formatter:         formatter,
+		cfg:               &cfg,
+		partialLogsBuffer: newPartialLogBuffer(int(cfg.PartialLogInitialSize), int(cfg.PartialLogMaxSize)),
+		sample:            rand.Float64,
+		clock:             realClock{},
+		closed:            make(chan struct{}),
+		logger:            zap.NewNop(),
+	}
+}
+
+func TestSendConcurrency(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{SendConcurrency: 4}, client)
+	l.startSenders(4)
+
+	want := make([]string, 100)
+	for i := range want {
+		want[i] = fmt.Sprint("line ", i)
+		if err := l.Log(&logger.Message{Line: []byte(want[i]), Timestamp: time.Now()}); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close logger: %v", err)
+	}
+
+	// The workers may reorder the logs.
+	got := slices.Clone(client.messages)
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected all %d logs to be sent, got %d", len(want), len(got))
+	}
+	if !client.closed {
+		t.Fatal("expected client to be closed")
+	}
+}
+
+func TestCloseWaitsForSenders(t *testing.T) {
+	client := &fakeClient{block: make(chan struct{})}
+	l := newTestLogger(t, loggerConfig{SendConcurrency: 4}, client)
+	l.startSenders(4)
+
+	// The workers block on the first logs, and the queue holds the others.
+	for i := range 8 {
+		if err := l.Log(&logger.Message{Line: []byte(fmt.Sprint("line ", i)), Timestamp: time.Now()}); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- l.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("expected Close to wait for the queued logs")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(client.block)
+	if err := <-closed; err != nil {
+		t.Fatalf("failed to close logger: %v", err)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	// The sends in progress are abandoned, but the queued logs are sent.
+	if sent := len(client.messages); sent < 4 || sent+int(l.abandoned.Load()) != 8 || l.dropped.Load() != 0 {
+		t.Fatalf("expected the queued logs to be sent, got %d sent, %d abandoned and %d dropped", sent, l.abandoned.Load(), l.dropped.Load())
+	}
+	if !client.closed {
+		t.Fatal("expected client to be closed")
+	}
+}
+
+func TestLogInvalidUTF8(t *testing.T) {
+	tests := []struct {
+		mode string
+		line string
+		want []string
+	}{
+		{mode: invalidUTF8Raw, line: "bad \xff\xfe byte", want: []string{"bad \xff\xfe byte"}},
+		{mode: invalidUTF8Replace, line: "bad \xff\xfe byte", want: []string{"bad \uFFFD byte"}},
+		{mode: invalidUTF8Replace, line: "truncated \xe6\x97", want: []string{"truncated \uFFFD"}},
+		{mode: invalidUTF8Replace, line: "日志 ok", want: []string{"日志 ok"}},
+		{mode: invalidUTF8Drop, line: "bad \xc0\x80 byte", want: nil},
+		{mode: invalidUTF8Drop, line: "日志 ok", want: []string{"日志 ok"}},
+	}
+	for _, tt := range tests {
+		client := &fakeClient{}
+		l := newTestLogger(t, loggerConfig{InvalidUTF8: tt.mode}, client)
+
+		msg := &logger.Message{Line: []byte(tt.line), Timestamp: time.Now()}
+		if err := l.Log(msg); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+		if !slices.Equal(client.messages, tt.want) {
+			t.Errorf("%s %q: expected %q, got %q", tt.mode, tt.line, tt.want, client.messages)
+		}
+		// The message is still logged as is to the local log file.
+		if string(msg.Line) != tt.line {
+			t.Errorf("%s %q: expected the logged message to be unchanged, got %q", tt.mode, tt.line, msg.Line)
+		}
+	}
+}
+
+// ackingClient acknowledges the logs sent only once ack is closed.
+// Like the producer, it waits for the acknowledgments when closed.
+type ackingClient struct {
+	fakeClient
+	pending atomic.Int64
+	ack     chan struct{}
+	// pendingOnClose is the number of logs still pending once the client
+	// was closed.
+	pendingOnClose int64
+}
+
+func (c *ackingClient) SendMessageCtx(ctx context.Context, message logMessage) error {
+	c.pending.Add(1)
+	go func() {
+		<-c.ack
+		c.pending.Add(-1)
+	}()
+	return c.fakeClient.SendMessageCtx(ctx, message)
+}
+
+func (c *ackingClient) Close(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for c.pending.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c.pendingOnClose = c.pending.Load()
+	return c.fakeClient.Close(timeout)
+}
+
+func TestCloseWaitsForAcknowledgments(t *testing.T) {
+	client := &ackingClient{ack: make(chan struct{})}
+	l := newTestLogger(t, loggerConfig{SendConcurrency: 4, ClientConfig: ClientConfig{CloseTimeout: 10 * time.Second}}, client)
+	l.startSenders(4)
+
+	for i := range 100 {
+		if err := l.Log(&logger.Message{Line: []byte(fmt.Sprint("line ", i)), Timestamp: time.Now()}); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- l.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("expected Close to wait for the logs to be acknowledged")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(client.ack)
+	if err := <-closed; err != nil {
+		t.Fatalf("failed to close logger: %v", err)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	// The client uploads the logs when closed, rather than being flushed
+	// and waiting for the batches to linger.
+	if len(client.sent) != 100 || client.flushed || !client.closed {
+		t.Fatalf("expected all logs to be sent before closing without flushing, got sent=%d flushed=%t closed=%t",
+			len(client.sent), client.flushed, client.closed)
+	}
+	if client.pendingOnClose != 0 {
+		t.Fatalf("expected no pending logs once the client is closed, got %d", client.pendingOnClose)
+	}
+}
+
+func TestCloseTimesOutWaitingForAcknowledgments(t *testing.T) {
+	client := &ackingClient{ack: make(chan struct{})}
+	defer close(client.ack)
+	l := newTestLogger(t, loggerConfig{ClientConfig: ClientConfig{CloseTimeout: 20 * time.Millisecond}}, client)
+
+	if err := l.Log(&logger.Message{Line: []byte("line"), Timestamp: time.Now()}); err != nil {
+		t.Fatalf("failed to log: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close logger: %v", err)
+	}
+
+	// The client is closed in the background once the timeout expires.
+	deadline := time.Now().Add(time.Second)
+	for {
+		client.mu.Lock()
+		closed := client.closed
+		client.mu.Unlock()
+		if closed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the client to be closed after the timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if client.pendingOnClose != 1 {
+		t.Fatalf("expected the unacknowledged log to be pending, got %d", client.pendingOnClose)
+	}
+}
+
+func TestCloseAbortsBlockedSend(t *testing.T) {
+	s, err := newSpool(zap.NewNop(), t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatalf("failed to create spool: %v", err)
+	}
+
+	client := &fakeClient{block: make(chan struct{})}
+	// Only a send with a deadline can be aborted while it's blocked.
+	l := newTestLogger(t, loggerConfig{SendDeadline: time.Hour}, client)
+	l.spool = s
+
+	logged := make(chan error, 1)
+	go func() {
+		logged <- l.Log(&logger.Message{Line: []byte("line"), Timestamp: time.Now()})
+	}()
+	// Let the Log call block in the client before closing.
+	time.Sleep(50 * time.Millisecond)
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close logger: %v", err)
+	}
+	select {
+	case <-logged:
+	case <-time.After(time.Second):
+		t.Fatal("expected Close to abort the blocked send")
+	}
+	if stats := l.Stats(); stats.Abandoned != 1 || stats.Dropped != 0 {
+		t.Fatalf("expected the aborted log to be abandoned but not dropped, got %d abandoned and %d dropped", stats.Abandoned, stats.Dropped)
+	}
+	if got := s.Len(); got != 0 {
+		t.Fatalf("expected the aborted log not to be spooled, got %d bytes", got)
+	}
+	if !client.closed {
+		t.Fatal("expected client to be closed")
+	}
+}
+
+func TestBlockingModeWaitsForBufferRoom(t *testing.T) {
+	p := &fakeProducer{block: make(chan struct{})}
+	cfg := ClientConfig{TopicID: "topic", Mode: modeBlocking}
+	l := newTestLogger(t, loggerConfig{ClientConfig: cfg}, newClient(zap.NewNop(), cfg, p))
+
+	logged := make(chan error, 1)
+	go func() {
+		logged <- l.Log(&logger.Message{Line: []byte("line"), Timestamp: time.Now()})
+	}()
+	select {
+	case err := <-logged:
+		t.Fatalf("expected Log to block on the full buffer, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Drain the buffer.
+	close(p.block)
+	select {
+	case err := <-logged:
+		if err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Log to return once the buffer is drained")
+	}
+	if len(p.logs) != 1 || l.Stats().Dropped != 0 {
+		t.Fatalf("expected the log to be sent without drops, got %d logs and %d dropped", len(p.logs), l.Stats().Dropped)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{
+		SampleRate:      0.25,
+		SampleKeepRegex: regexp.MustCompile(`ERROR`),
+	}, client)
+	l.sample = rand.New(rand.NewPCG(1, 2)).Float64
+
+	const n = 10000
+	for i := range n {
+		line := "info line"
+		if i%100 == 0 {
+			line = "ERROR line"
+		}
+		if err := l.Log(&logger.Message{Line: []byte(line)}); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+
+	var kept, errorsKept int
+	for _, text := range client.messages {
+		if strings.Contains(text, "ERROR") {
+			errorsKept++
+		} else {
+			kept++
+		}
+	}
+	if errorsKept != n/100 {
+		t.Fatalf("expected every error line to be kept, got %d of %d", errorsKept, n/100)
+	}
+	// The info lines are kept at about the sample rate.
+	if rate := float64(kept) / (n - n/100); rate < 0.23 || rate > 0.27 {
+		t.Fatalf("expected about 25%% of the info lines to be kept, got %.3f", rate)
+	}
+	if got := l.Stats().Sampled; got != int64(n-len(client.messages)) {
+		t.Fatalf("expected %d sampled out logs, got %d", n-len(client.messages), got)
+	}
+}
+
+func TestSamplingRateBounds(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{}, client)
+	l.cfg.SampleRate = 0
+
+	for range 10 {
+		if err := l.Log(&logger.Message{Line: []byte("line")}); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+	if len(client.messages) != 0 || l.Stats().Sampled != 10 {
+		t.Fatalf("expected every log to be sampled out, got %d sent", len(client.messages))
+	}
+
+	l.cfg.SampleRate = 1
+	l.sample = func() float64 { t.Fatal("expected no sampling at rate 1"); return 0 }
+	if err := l.Log(&logger.Message{Line: []byte("line")}); err != nil {
+		t.Fatalf("failed to log: %v", err)
+	}
+	if len(client.messages) != 1 {
+		t.Fatalf("expected the log to be kept, got %d sent", len(client.messages))
+	}
+}
+
+func TestThroughputReporter(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	l := newTestLogger(t, loggerConfig{ThroughputInterval: 10 * time.Second}, &fakeClient{})
+	l.logger = zap.New(core)
+	l.formatter.containerDetails = &ContainerDetails{ContainerID: "4f66d5c6b9a8"}
+	clock := newFakeClock(time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC))
+	l.clock = clock
+
+	l.wg.Add(1)
+	go l.runThroughputReporter()
+	defer l.Close()
+	<-clock.created
+
+	waitReport := func(n int) map[string]any {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for logs.FilterMessage("logger throughput").Len() < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d throughput reports, got %d", n, logs.FilterMessage("logger throughput").Len())
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return logs.FilterMessage("logger throughput").All()[n-1].ContextMap()
+	}
+
+	for range 50 {
+		if err := l.Log(&logger.Message{Line: []byte("0123456789"), Timestamp: time.Now()}); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+	clock.Advance(10 * time.Second)
+	report := waitReport(1)
+	want := map[string]any{
+		"container_id":   "4f66d5c6b9a8",
+		"messages":       int64(50),
+		"bytes":          int64(500),
+		"messagesPerSec": 5.0,
+		"bytesPerSec":    50.0,
+	}
+	if !maps.Equal(report, want) {
+		t.Fatalf("expected report %v, got %v", want, report)
+	}
+
+	// The rates are since the previous report.
+	for range 20 {
+		if err := l.Log(&logger.Message{Line: []byte("01234"), Timestamp: time.Now()}); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+	clock.Advance(10 * time.Second)
+	report = waitReport(2)
+	if report["messages"] != int64(20) || report["bytes"] != int64(100) || report["messagesPerSec"] != 2.0 {
+		t.Fatalf("expected 20 messages of 100 bytes since the previous report, got %v", report)
+	}
+}
+
+func TestPartialLogSweeperTicksWithClock(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{PartialLogTimeout: time.Minute}, client)
+	clock := newFakeClock(time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC))
+	l.clock = clock
+
+	err := l.Log(&logger.Message{Line: []byte("partial"), PLogMetaData: &backend.PartialLogMetaData{ID: "p", Ordinal: 1}})
+	if err != nil {
+		t.Fatalf("failed to log: %v", err)
+	}
+	l.wg.Add(1)
+	go l.runPartialLogSweeper()
+	defer l.Close()
+	<-clock.created
+
+	// The partial log is stale at the tick past the timeout.
+	clock.Advance(2 * time.Minute)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		client.mu.Lock()
+		sent := slices.Clone(client.messages)
+		client.mu.Unlock()
+		if len(sent) == 1 && sent[0] == "partial" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the stale partial log to be flushed on tick, got %v", sent)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDedupCollapsesRepeats(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{DedupWindow: time.Minute}, client)
+
+	for _, line := range []string{"reconnecting", "reconnecting", "reconnecting", "connected", "reconnecting"} {
+		if err := l.Log(&logger.Message{Line: []byte(line), Source: "stdout"}); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+	// A line from another stream isn't a repeat.
+	if err := l.Log(&logger.Message{Line: []byte("reconnecting"), Source: "stderr"}); err != nil {
+		t.Fatalf("failed to log: %v", err)
+	}
+
+	if len(client.sent) != 3 {
+		t.Fatalf("expected the held logs to be sent on change, got %d logs", len(client.sent))
+	}
+	// The last log is held until Close.
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close logger: %v", err)
+	}
+
+	want := []struct {
+		text   string
+		repeat int
+	}{
+		{text: "reconnecting", repeat: 3},
+		{text: "connected", repeat: 1},
+		{text: "reconnecting", repeat: 1},
+		{text: "reconnecting", repeat: 1},
+	}
+	if len(client.sent) != len(want) {
+		t.Fatalf("expected %d logs, got %d", len(want), len(client.sent))
+	}
+	for i, w := range want {
+		if got := client.sent[i]; got.Text != w.text || got.Repeat != w.repeat {
+			t.Errorf("log %d: expected %q repeated %d times, got %q repeated %d times", i, w.text, w.repeat, got.Text, got.Repeat)
+		}
+	}
+}
+
+func TestDedupWindowExpires(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{DedupWindow: 20 * time.Millisecond}, client)
+	l.wg.Add(1)
+	go l.runDedupFlusher()
+	defer l.Close()
+
+	for range 2 {
+		if err := l.Log(&logger.Message{Line: []byte("line")}); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		client.mu.Lock()
+		sent := slices.Clone(client.sent)
+		client.mu.Unlock()
+		if len(sent) == 1 {
+			if sent[0].Repeat != 2 {
+				t.Fatalf("expected the log repeated 2 times, got %d", sent[0].Repeat)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the held log to be sent once the window expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDedupRepeatPastWindow(t *testing.T) {
+	l := newTestLogger(t, loggerConfig{DedupWindow: time.Minute}, &fakeClient{})
+	if err := l.Log(&logger.Message{Line: []byte("line")}); err != nil {
+		t.Fatalf("failed to log: %v", err)
+	}
+
+	msg := &logger.Message{Line: []byte("line")}
+	if l.repeatDedup(msg, time.Now().Add(2*time.Minute)) {
+		t.Fatal("expected a repeat past the window not to be counted")
+	}
+	if !l.repeatDedup(msg, time.Now()) {
+		t.Fatal("expected a repeat within the window to be counted")
+	}
+}
+
+func TestFlushFlushesClient(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{}, client)
+
+	if err := l.Log(&logger.Message{Line: []byte("line"), Timestamp: time.Now()}); err != nil {
+		t.Fatalf("failed to log: %v", err)
+	}
+	if err := l.Flush(context.Background()); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if !client.flushed || len(client.sent) != 1 {
+		t.Fatalf("expected the logged message to be flushed, got flushed=%t sent=%d", client.flushed, len(client.sent))
+	}
+}
+
+func TestSendDeadline(t *testing.T) {
+	client := &fakeClient{block: make(chan struct{})}
+	defer close(client.block)
+	l := newTestLogger(t, loggerConfig{SendDeadline: 50 * time.Millisecond}, client)
+
+	start := time.Now()
+	if err := l.Log(&logger.Message{Line: []byte("stuck"), Timestamp: time.Now()}); err != nil {
+		t.Fatalf("failed to log: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the log to be abandoned after the deadline, took %s", elapsed)
+	}
+	if stats := l.Stats(); stats.Abandoned != 1 || stats.Dropped != 0 {
+		t.Fatalf("expected the log to be abandoned but not dropped, got %d abandoned and %d dropped", stats.Abandoned, stats.Dropped)
+	}
+}
+
+// ctxClient records whether the contexts of the sends can be done.
+type ctxClient struct {
+	*fakeClient
+	cancellable []bool
+}
+
+func (c *ctxClient) SendMessageCtx(ctx context.Context, msg logMessage) error {
+	c.cancellable = append(c.cancellable, ctx.Done() != nil)
+	return c.fakeClient.SendMessageCtx(ctx, msg)
+}
+
+func TestSendContextCancellable(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		deadline time.Duration
+		want     bool
+	}{
+		{name: "no deadline", want: false},
+		{name: "deadline", deadline: time.Minute, want: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &ctxClient{fakeClient: &fakeClient{}}
+			l := newTestLogger(t, loggerConfig{SendDeadline: tc.deadline}, client)
+
+			if err := l.Log(&logger.Message{Line: []byte("line"), Timestamp: time.Now()}); err != nil {
+				t.Fatalf("failed to log: %v", err)
+			}
+			if len(client.cancellable) != 1 || client.cancellable[0] != tc.want {
+				t.Fatalf("expected cancellable send context %t, got %v", tc.want, client.cancellable)
+			}
+		})
+	}
+}
+
+func TestCloseClosesClient(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{}, client)
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close logger: %v", err)
+	}
+	if !client.closed {
+		t.Fatal("expected client to be closed")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close logger twice: %v", err)
+	}
+}
+
+func TestPartialLogBufferEvict(t *testing.T) {
+	b := newPartialLogBuffer(int(defaultLoggerConfig.PartialLogInitialSize), 0)
+
+	partial := &logger.Message{
+		Line:         []byte("abandoned "),
+		PLogMetaData: &backend.PartialLogMetaData{ID: "1"},
+	}
+	if _, last := b.Append(partial, time.Now()); last {
+		t.Fatal("expected partial log not to be complete")
+	}
+
+	if evicted := b.Evict(time.Now().Add(-time.Minute)); len(evicted) != 0 {
+		t.Fatalf("expected no fresh partial log to be evicted, got %d", len(evicted))
+	}
+
+	evicted := b.Evict(time.Now().Add(time.Minute))
+	if len(evicted) != 1 || string(evicted[0].Line) != "abandoned " {
+		t.Fatalf("expected the abandoned partial log to be evicted, got %v", evicted)
+	}
+	if len(b.logs) != 0 {
+		t.Fatalf("expected buffer to be empty, got %d entries", len(b.logs))
+	}
+}
+
+func TestPartialLogBufferInitialSize(t *testing.T) {
+	b := newPartialLogBuffer(1<<20, 0)
+
+	if _, last := b.Append(&logger.Message{
+		Line:         []byte("partial"),
+		PLogMetaData: &backend.PartialLogMetaData{ID: "1"},
+	}, time.Now()); last {
+		t.Fatal("expected partial log not to be complete")
+	}
+	if got := cap(b.logs["1"].msg.Line); got != 1<<20 {
+		t.Fatalf("expected capacity %d, got %d", 1<<20, got)
+	}
+}
+
+func TestLogFlushesPartialLogAtMaxSize(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{PartialLogMaxSize: 10}, client)
+
+	for _, chunk := range []string{"aaaa", "bbbb", "cccc", "dddd"} {
+		err := l.Log(&logger.Message{
+			Line:         []byte(chunk),
+			PLogMetaData: &backend.PartialLogMetaData{ID: "1"},
+		})
+		if err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+
+	want := []string{"aaaabbbbcccc"}
+	if !slices.Equal(client.messages, want) {
+		t.Fatalf("expected %v to be flushed without the last partial message, got %v", want, client.messages)
+	}
+	if got := string(l.partialLogsBuffer.logs["1"].msg.Line); got != "dddd" {
+		t.Fatalf("expected a new log to be assembled, got %q", got)
+	}
+}
+
+// BenchmarkPartialLogBufferAppend assembles 1MB logs from 64 partial messages
+// of 16KB, as Docker splits long lines, with different initial sizes.
+func BenchmarkPartialLogBufferAppend(b *testing.B) {
+	chunk := bytes.Repeat([]byte("x"), 16<<10)
+	for _, initialSize := range []int{1 << 10, 16 << 10, 1 << 20} {
+		b.Run(fmt.Sprint(initialSize), func(b *testing.B) {
+			buf := newPartialLogBuffer(initialSize, 0)
+			b.ReportAllocs()
+			for range b.N {
+				for i := range 64 {
+					buf.Append(&logger.Message{
+						Line:         chunk,
+						PLogMetaData: &backend.PartialLogMetaData{ID: "1", Last: i == 63},
+					}, time.Time{})
+				}
+			}
+		})
+	}
+}
+
+func TestPartialLogSweeperFlushesStaleLogs(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{PartialLogTimeout: 10 * time.Millisecond}, client)
+	l.wg.Add(1)
+	go l.runPartialLogSweeper()
+
+	err := l.Log(&logger.Message{
+		Line:         []byte("abandoned"),
+		PLogMetaData: &backend.PartialLogMetaData{ID: "1"},
+	})
+	if err != nil {
+		t.Fatalf("failed to log: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		client.mu.Lock()
+		sent := len(client.messages)
+		client.mu.Unlock()
+		if sent == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected stale partial log to be flushed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close logger: %v", err)
+	}
+	if client.messages[0] != "abandoned" {
+		t.Fatalf("unexpected message %q", client.messages[0])
+	}
+}
+
+func TestLogPassesMessageTimestamp(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{}, client)
+
+	timestamp := time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC)
+	if err := l.Log(&logger.Message{Line: []byte("line"), Timestamp: timestamp}); err != nil {
+		t.Fatalf("failed to log: %v", err)
+	}
+
+	if !client.sent[0].Timestamp.Equal(timestamp) {
+		t.Fatalf("expected timestamp %v, got %v", timestamp, client.sent[0].Timestamp)
+	}
+}
+
+func TestFormatOwnerTag(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "present", labels: map[string]string{"team": "payments"}, want: "payments: line"},
+		{name: "absent", labels: map[string]string{}, want: ": line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &loggerConfig{Template: "{owner}: {log}", ClientConfig: ClientConfig{OwnerLabel: "team"}}
+			formatter, err := newMessageFormatter(&ContainerDetails{ContainerLabels: tt.labels}, cfg)
+			if err != nil {
+				t.Fatalf("failed to create message formatter: %v", err)
+			}
+
+			if got := formatter.Format(&logger.Message{Line: []byte("line")}); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+type blockingCloseClient struct {
+	fakeClient
+	release chan struct{}
+}
+
+func (c *blockingCloseClient) Close(timeout time.Duration) error {
+	<-c.release
+	return c.fakeClient.Close(timeout)
+}
+
+func TestCloseTimeout(t *testing.T) {
+	client := &blockingCloseClient{release: make(chan struct{})}
+	defer close(client.release)
+
+	l := newTestLogger(t, loggerConfig{ClientConfig: ClientConfig{CloseTimeout: 50 * time.Millisecond}}, client)
+	clock := newFakeClock(time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC))
+	l.clock = clock
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- l.Close()
+	}()
+	<-clock.created
+
+	clock.Advance(50 * time.Millisecond)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("failed to close logger: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected close to return after the timeout")
+	}
+}
+
+// slowSendClient takes sendTime of the clock to send a log.
+type slowSendClient struct {
+	fakeClient
+	clock    *fakeClock
+	sendTime time.Duration
+}
+
+func (c *slowSendClient) SendMessageCtx(ctx context.Context, message logMessage) error {
+	c.clock.Advance(c.sendTime)
+	return c.fakeClient.SendMessageCtx(ctx, message)
+}
+
+func TestCloseSharesTimeout(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC))
+	client := &slowSendClient{clock: clock, sendTime: 4 * time.Second}
+	l := newTestLogger(t, loggerConfig{DedupWindow: time.Minute, ClientConfig: ClientConfig{CloseTimeout: 10 * time.Second}}, client)
+	l.clock = clock
+
+	// The log is held until Close sends it.
+	if err := l.Log(&logger.Message{Line: []byte("line"), Timestamp: time.Now()}); err != nil {
+		t.Fatalf("failed to log: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close logger: %v", err)
+	}
+	// The client is given what's left of the close timeout after the send.
+	if len(client.sent) != 1 || !client.closed || client.closeTimeout != 6*time.Second {
+		t.Fatalf("expected the held log sent and client closed within 6s, got sent=%d closed=%t timeout=%s",
+			len(client.sent), client.closed, client.closeTimeout)
+	}
+}
+
+func TestLogDuringSlowClose(t *testing.T) {
+	client := &blockingCloseClient{release: make(chan struct{})}
+	defer close(client.release)
+
+	l := newTestLogger(t, loggerConfig{ClientConfig: ClientConfig{CloseTimeout: 50 * time.Millisecond}}, client)
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close logger: %v", err)
+	}
+
+	// The client is still being closed in the background.
+	logged := make(chan error, 1)
+	go func() {
+		logged <- l.Log(&logger.Message{Line: []byte("line"), Timestamp: time.Now()})
+	}()
+	select {
+	case err := <-logged:
+		if !errors.Is(err, errLoggerClosed) {
+			t.Fatalf("expected logger closed error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Log not to wait for the client to be closed")
+	}
+}
+
+func TestCloseUnregistersMetricsOnTimeout(t *testing.T) {
+	client := &blockingCloseClient{release: make(chan struct{})}
+	defer close(client.release)
+
+	l := newTestLogger(t, loggerConfig{ClientConfig: ClientConfig{CloseTimeout: 50 * time.Millisecond}}, client)
+	unregistered := make(chan struct{})
+	l.unregisterMetrics = func() { close(unregistered) }
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close logger: %v", err)
+	}
+	select {
+	case <-unregistered:
+	case <-time.After(time.Second):
+		t.Fatal("expected the metrics to be unregistered while the client is being closed")
+	}
+}
+
+func TestSchemaDescriptor(t *testing.T) {
+	l := newTestLogger(t, loggerConfig{Template: "{container_name}: {log}"}, &fakeClient{})
+
+	var record map[string]string
+	if err := json.Unmarshal([]byte(l.schemaDescriptor(time.Now()).Text), &record); err != nil {
+		t.Fatalf("invalid schema descriptor: %v", err)
+	}
+
+	want := "__hostname__,__original_text__"
+	if record["__schema__"] != want {
+		t.Fatalf("expected fields %q, got %q", want, record["__schema__"])
+	}
+}
+
+func TestFormatSourceTag(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{Template: "[{source}] {log}"}, client)
+
+	if err := l.Log(&logger.Message{Line: []byte("line"), Source: "stdout"}); err != nil {
+		t.Fatalf("failed to log: %v", err)
+	}
+
+	if client.sent[0].Text != "[stdout] line" || client.sent[0].Source != "stdout" {
+		t.Fatalf("unexpected message %+v", client.sent[0])
+	}
+}
+
+func TestFilterMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		want int
+	}{
+		{mode: filterModeInclude, want: 1},
+		{mode: filterModeExclude, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			client := &fakeClient{}
+			l := newTestLogger(t, loggerConfig{
+				FilterRegexes: []*regexp.Regexp{regexp.MustCompile("healthz")},
+				FilterMode:    tt.mode,
+			}, client)
+
+			if err := l.Log(&logger.Message{Line: []byte("GET /healthz 200")}); err != nil {
+				t.Fatalf("failed to log: %v", err)
+			}
+			if len(client.sent) != tt.want {
+				t.Fatalf("expected %d sent messages, got %d", tt.want, len(client.sent))
+			}
+		})
+	}
+}
+
+func TestFormatK8sPodUIDTag(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "present", labels: map[string]string{k8sPodUIDLabel: "6f1c7d0e"}, want: "6f1c7d0e line"},
+		{name: "absent", labels: nil, want: " line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			formatter, err := newMessageFormatter(&ContainerDetails{ContainerLabels: tt.labels}, &loggerConfig{Template: "{k8s_pod_uid} {log}"})
+			if err != nil {
+				t.Fatalf("failed to create message formatter: %v", err)
+			}
+			if got := formatter.Format(&logger.Message{Line: []byte("line")}); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFormatLineOnlyTemplate(t *testing.T) {
+	formatter, err := newMessageFormatter(&ContainerDetails{}, &loggerConfig{Template: lineOnlyTemplate})
+	if err != nil {
+		t.Fatalf("failed to create message formatter: %v", err)
+	}
+	if !formatter.lineOnly {
+		t.Fatal("expected the default template to be formatted as the line")
+	}
+
+	for _, line := range []string{"", "line", `{"log":"{log}"}`, "日志 \x00\xff"} {
+		msg := &logger.Message{Line: []byte(line), Timestamp: time.Now()}
+		if got, want := formatter.Format(msg), formatter.template.ExecuteFuncString(formatter.tagFunc(msg)); got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	}
+
+	for _, template := range []string{"{log} ", "{log:upper}", "{timestamp} {log}"} {
+		formatter, err := newMessageFormatter(&ContainerDetails{}, &loggerConfig{Template: template})
+		if err != nil {
+			t.Fatalf("failed to create message formatter: %v", err)
+		}
+		if formatter.lineOnly {
+			t.Errorf("expected template %q to be executed", template)
+		}
+	}
+}
+
+// BenchmarkFormatLineOnly compares formatting short lines with the default
+// template as the line itself and by executing the template.
+func BenchmarkFormatLineOnly(b *testing.B) {
+	formatter, err := newMessageFormatter(&ContainerDetails{}, &loggerConfig{Template: lineOnlyTemplate})
+	if err != nil {
+		b.Fatalf("failed to create message formatter: %v", err)
+	}
+	msg := &logger.Message{Line: []byte("GET /healthz 200 1.2ms"), Timestamp: time.Now()}
+
+	for _, lineOnly := range []bool{true, false} {
+		b.Run(fmt.Sprintf("lineOnly=%v", lineOnly), func(b *testing.B) {
+			formatter.lineOnly = lineOnly
+			b.ReportAllocs()
+			for range b.N {
+				formatter.Format(msg)
+			}
+		})
+	}
+}
+
+func TestFormatTo(t *testing.T) {
+	for _, template := range []string{lineOnlyTemplate, "{timestamp} {container_name:upper} {log:truncate:4}"} {
+		formatter, err := newMessageFormatter(&ContainerDetails{ContainerName: "/app"}, &loggerConfig{Template: template})
+		if err != nil {
+			t.Fatalf("failed to create message formatter: %v", err)
+		}
+		msg := &logger.Message{Line: []byte("line 1"), Timestamp: time.Now()}
+
+		var buf bytes.Buffer
+		n, err := formatter.FormatTo(&buf, msg)
+		if err != nil {
+			t.Fatalf("failed to format: %v", err)
+		}
+		if want := formatter.Format(msg); buf.String() != want || n != int64(len(want)) {
+			t.Errorf("template %q: expected %q, got %q (%d bytes)", template, want, buf.String(), n)
+		}
+	}
+}
+
+func TestPutBufferDropsLargeBuffers(t *testing.T) {
+	buf := getBuffer()
+	buf.Grow(2 * maxPooledBufferSize)
+	putBuffer(buf)
+
+	// The pool may drop buffers at any time, so only a returned buffer is checked.
+	if got := getBuffer(); got == buf {
+		t.Fatal("expected a large buffer not to be pooled")
+	} else if got.Len() != 0 {
+		t.Fatalf("expected a reset buffer, got %q", got.String())
+	}
+}
+
+// BenchmarkFormat formats short lines with tags and modifiers, either into
+// a string or streamed to a reused buffer.
+func BenchmarkFormat(b *testing.B) {
+	formatter, err := newMessageFormatter(
+		&ContainerDetails{ContainerName: "/app", ContainerLabels: map[string]string{"team": "infra"}},
+		&loggerConfig{Template: "{timestamp} {container_name} {label.team:upper} {log:truncate:512}"},
+	)
+	if err != nil {
+		b.Fatalf("failed to create message formatter: %v", err)
+	}
+	msg := &logger.Message{Line: []byte("GET /healthz 200 1.2ms"), Timestamp: time.Now()}
+
+	b.Run("Format", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			formatter.Format(msg)
+		}
+	})
+	b.Run("FormatTo", func(b *testing.B) {
+		var buf bytes.Buffer
+		b.ReportAllocs()
+		for range b.N {
+			buf.Reset()
+			_, _ = formatter.FormatTo(&buf, msg)
+		}
+	})
+}
+
+func TestFormatHostnameTag(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("failed to get hostname: %v", err)
+	}
+
+	formatter, err := newMessageFormatter(&ContainerDetails{}, &loggerConfig{Template: "{hostname} {log}"})
+	if err != nil {
+		t.Fatalf("failed to create message formatter: %v", err)
+	}
+	if got, want := formatter.Format(&logger.Message{Line: []byte("line")}), hostname+" line"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	// The hostname is resolved once, not on every log.
+	formatter.hostname = "cached"
+	if got, want := formatter.Format(&logger.Message{Line: []byte("line")}), "cached line"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	formatter.hostname = ""
+	if got, want := formatter.Format(&logger.Message{Line: []byte("line")}), " line"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestFormatHostnameTagOverride(t *testing.T) {
+	cfg := &loggerConfig{Template: "{hostname} {log}", ClientConfig: ClientConfig{Hostname: "node-1"}}
+	formatter, err := newMessageFormatter(&ContainerDetails{}, cfg)
+	if err != nil {
+		t.Fatalf("failed to create message formatter: %v", err)
+	}
+	if got, want := formatter.Format(&logger.Message{Line: []byte("line")}), "node-1 line"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestFormatContainerCreatedTag(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatalf("failed to load location: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		created time.Time
+		want    string
+	}{
+		{name: "timezone", created: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), want: "2024-01-02T11:04:05+08:00 line"},
+		{name: "zero", created: time.Time{}, want: " line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &loggerConfig{Template: "{container_created} {log}", TimestampLocation: shanghai}
+			formatter, err := newMessageFormatter(&ContainerDetails{ContainerCreated: tt.created}, cfg)
+			if err != nil {
+				t.Fatalf("failed to create message formatter: %v", err)
+			}
+			if got := formatter.Format(&logger.Message{Line: []byte("line")}); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFilterCombine(t *testing.T) {
+	regexes := []*regexp.Regexp{regexp.MustCompile("GET"), regexp.MustCompile(" 5[0-9]{2}$")}
+	lines := []string{"GET /a 200", "GET /b 503", "POST /c 500", "POST /d 201"}
+
+	tests := []struct {
+		combine string
+		want    []string
+	}{
+		{combine: filterCombineAny, want: []string{"GET /a 200", "GET /b 503", "POST /c 500"}},
+		{combine: filterCombineAll, want: []string{"GET /b 503"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.combine, func(t *testing.T) {
+			client := &fakeClient{}
+			l := newTestLogger(t, loggerConfig{FilterRegexes: regexes, FilterCombine: tt.combine}, client)
+
+			for _, line := range lines {
+				if err := l.Log(&logger.Message{Line: []byte(line)}); err != nil {
+					t.Fatalf("failed to log: %v", err)
+				}
+			}
+			if !slices.Equal(client.messages, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, client.messages)
+			}
+		})
+	}
+}
+
+func TestFormatJSONFields(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{
+		Format:     formatJSON,
+		JSONFields: []string{"log", "source", "timestamp"},
+	}, client)
+
+	timestamp := time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC)
+	err := l.Log(&logger.Message{Line: []byte(`{"not": "parsed"}`), Source: "stderr", Timestamp: timestamp})
+	if err != nil {
+		t.Fatalf("failed to log: %v", err)
+	}
+
+	want := map[string]string{
+		"log":       `{"not": "parsed"}`,
+		"source":    "stderr",
+		"timestamp": "2024-06-01T13:00:00Z",
+	}
+	if !maps.Equal(client.sent[0].Fields, want) {
+		t.Fatalf("expected fields %v, got %v", want, client.sent[0].Fields)
+	}
+}
+
+func TestFormatJSONFieldsUnknownTag(t *testing.T) {
+	_, err := newMessageFormatter(&ContainerDetails{}, &loggerConfig{Template: "{log}", JSONFields: []string{"log", "nope"}})
+	if !errors.Is(err, errUnknownTag) {
+		t.Fatalf("expected unknown tag error, got %v", err)
+	}
+}
+
+func TestValidateTemplateListsUnknownTags(t *testing.T) {
+	cfg := &loggerConfig{
+		Template:   "{nope} {log} {service} {label.team} {env.MISSING} {typo} {nope}",
+		JSONFields: []string{"log", "missing"},
+		Attrs:      map[string]string{"service": "api"},
+	}
+	_, err := newMessageFormatter(&ContainerDetails{}, cfg)
+	if !errors.Is(err, errUnknownTag) {
+		t.Fatalf("expected unknown tag error, got %v", err)
+	}
+	if want := "unknown tag: nope, typo, missing"; err.Error() != want {
+		t.Fatalf("expected error %q, got %q", want, err.Error())
+	}
+}
+
+func TestTemplateMustBeJSON(t *testing.T) {
+	tests := []struct {
+		template string
+		valid    bool
+	}{
+		{"{log}", true},
+		{"{container_name}: {log}", false},
+		{"[{log}]", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			_, err := newMessageFormatter(&ContainerDetails{}, &loggerConfig{Template: tt.template, TemplateMustBeJSON: true})
+			if tt.valid && err != nil {
+				t.Fatalf("expected valid template, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("expected error for template not formatting to JSON")
+			}
+		})
+	}
+}
+
+func TestFormatLabelAndEnvTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		details *ContainerDetails
+		want    string
+	}{
+		{
+			name: "present",
+			details: &ContainerDetails{
+				ContainerLabels: map[string]string{"com.example.team": "infra"},
+				ContainerEnv:    []string{"PATH=/bin", "APP_VERSION=1.2.3", "TOKEN=a=b"},
+			},
+			want: "infra 1.2.3 a=b line",
+		},
+		{name: "absent", details: &ContainerDetails{ContainerEnv: []string{"APP_VERSION_OLD=1"}}, want: "   line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			formatter, err := newMessageFormatter(tt.details, &loggerConfig{Template: "{label.com.example.team} {env.APP_VERSION} {env.TOKEN} {log}"})
+			if err != nil {
+				t.Fatalf("failed to create message formatter: %v", err)
+			}
+			if got := formatter.Format(&logger.Message{Line: []byte("line")}); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := newMessageFormatter(&ContainerDetails{}, &loggerConfig{Template: "{labels.team}"}); !errors.Is(err, errUnknownTag) {
+		t.Fatalf("expected unknown tag error for unprefixed tag, got %v", err)
+	}
+}
+
+func TestFormatContainerIDTags(t *testing.T) {
+	fullID := "4f66d5c6b9a8e3c1a2b0f9d8c7e6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e0d9c8"
+	formatter, err := newMessageFormatter(&ContainerDetails{ContainerID: fullID}, &loggerConfig{Template: "{container_id} {container_short_id} {container_full_id}"})
+	if err != nil {
+		t.Fatalf("failed to create message formatter: %v", err)
+	}
+
+	want := fullID[:12] + " " + fullID[:12] + " " + fullID
+	if got := formatter.Format(&logger.Message{}); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestFormatTagModifiers(t *testing.T) {
+	tests := []struct {
+		template string
+		line     string
+		want     string
+	}{
+		{template: "{log:truncate:5}", line: "hello world", want: "hello"},
+		{template: "{log:truncate:20}", line: "hello world", want: "hello world"},
+		{template: "{log:truncate:0}", line: "hello", want: ""},
+		// 日 and 志 are 3 bytes long: a rune cut in the middle is dropped.
+		{template: "{log:truncate:4}", line: "日志abc", want: "日"},
+		{template: "{log:truncate:6}", line: "日志abc", want: "日志"},
+		{template: "{log:truncate:2}", line: "日志abc", want: ""},
+		{template: "{log:upper}", line: "Warn", want: "WARN"},
+		{template: "{log:lower:truncate:3}", line: "WARN", want: "war"},
+		{template: "{label.tier:upper}-{log}", line: "line", want: "WEB-line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			details := &ContainerDetails{ContainerLabels: map[string]string{"tier": "web"}}
+			formatter, err := newMessageFormatter(details, &loggerConfig{Template: tt.template})
+			if err != nil {
+				t.Fatalf("failed to create message formatter: %v", err)
+			}
+			if got := formatter.Format(&logger.Message{Line: []byte(tt.line)}); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFormatTagModifiersInvalid(t *testing.T) {
+	for _, template := range []string{"{log:reverse}", "{log:truncate}", "{log:truncate:-1}", "{log:truncate:abc}", "{log:}"} {
+		if _, err := newMessageFormatter(&ContainerDetails{}, &loggerConfig{Template: template}); !errors.Is(err, errUnknownTagModifier) {
+			t.Errorf("%s: expected unknown tag modifier error, got %v", template, err)
+		}
+	}
+}
+
+func TestNewTencentCLSLoggerRedactsSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	zapLogger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewDevelopmentEncoderConfig()), zapcore.AddSync(&buf), zap.DebugLevel))
+
+	secrets := []string{"AKIDsecretid0123", "secretkey4567", "securitytoken89", "secret-zone"}
+	details := &ContainerDetails{Config: map[string]string{
+		cfgEndpointKey:      "ap-guangzhou.cls.tencentcs.com",
+		cfgTopicIDKey:       "topic",
+		cfgSecretIDKey:      secrets[0],
+		cfgSecretKeyKey:     secrets[1],
+		cfgSecurityTokenKey: secrets[2],
+		cfgInstanceInfoKey:  `{"zone":"secret-zone"}`,
+	}}
+
+	l, err := NewTencentCLSLogger(zapLogger, details)
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close logger: %v", err)
+	}
+
+	output := buf.String() + l.cfg.ClientConfig.String()
+	if !strings.Contains(output, "****0123") {
+		t.Fatalf("expected masked secret ID in output, got %s", output)
+	}
+	for _, secret := range secrets {
+		if strings.Contains(output, secret) {
+			t.Fatalf("expected %q to be masked in output, got %s", secret, output)
+		}
+	}
+}
+
+func TestNewTencentCLSLoggerWithClient(t *testing.T) {
+	details := &ContainerDetails{Config: map[string]string{
+		cfgEndpointKey:  "ap-guangzhou.cls.tencentcs.com",
+		cfgTopicIDKey:   "topic",
+		cfgSecretIDKey:  "id",
+		cfgSecretKeyKey: "key",
+	}}
+	client := &fakeClient{}
+	l, err := NewTencentCLSLogger(zap.NewNop(), details, WithClient(client))
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+
+	messages := []*logger.Message{
+		{Line: []byte("first")},
+		{Line: []byte("sec"), PLogMetaData: &backend.PartialLogMetaData{ID: "p", Ordinal: 1}},
+		{Line: []byte("third")},
+		{Line: []byte("ond"), PLogMetaData: &backend.PartialLogMetaData{ID: "p", Ordinal: 2, Last: true}},
+		{Line: []byte("fourth")},
+	}
+	for _, msg := range messages {
+		if err := l.Log(msg); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close logger: %v", err)
+	}
+
+	// The partial log is sent once assembled, in the order its last chunk arrived.
+	want := []string{"first", "third", "second", "fourth"}
+	if !slices.Equal(client.messages, want) {
+		t.Fatalf("expected messages %v, got %v", want, client.messages)
+	}
+	if !client.closed {
+		t.Fatal("expected the injected client to be closed")
+	}
+}
+
+func TestNewTencentCLSLoggerHealthcheckOnStart(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"errorcode":"AuthFailure","errormessage":"invalid secret id"}`))
+	}))
+	defer server.Close()
+
+	details := &ContainerDetails{Config: map[string]string{
+		cfgEndpointKey:           strings.TrimPrefix(server.URL, "http://"),
+		cfgTopicIDKey:            "topic",
+		cfgSecretIDKey:           "id",
+		cfgSecretKeyKey:          "key",
+		cfgHealthcheckOnStartKey: "true",
+	}}
+
+	_, err := NewTencentCLSLogger(zap.NewNop(), details)
+	if err == nil || !strings.Contains(err.Error(), "AuthFailure: invalid secret id") {
+		t.Fatalf("expected health check error, got %v", err)
+	}
+}
+
+func TestLoggerHealthCheck(t *testing.T) {
+	client := &fakeClient{unhealthy: errors.New("unreachable")}
+	l := newTestLogger(t, loggerConfig{}, client)
+
+	if err := l.HealthCheck(context.Background()); !errors.Is(err, client.unhealthy) {
+		t.Fatalf("expected client health check error, got %v", err)
+	}
+}
+
+func TestLogDisabled(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{Disabled: true}, client)
+
+	if err := l.Log(&logger.Message{Line: []byte("line")}); err != nil {
+		t.Fatalf("failed to log: %v", err)
+	}
+	if len(client.sent) != 0 {
+		t.Fatalf("expected no message to be sent, got %d", len(client.sent))
+	}
+}
+
+func TestLogLevelRegex(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{LevelRegex: regexp.MustCompile(`\b(INFO|WARN|ERROR)\b`)}, client)
+
+	for _, line := range []string{"2024-01-02 ERROR disk full", "no level here"} {
+		if err := l.Log(&logger.Message{Line: []byte(line), Timestamp: time.Now()}); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+
+	if got := client.sent[0].Level; got != "ERROR" {
+		t.Errorf("expected level ERROR, got %q", got)
+	}
+	if got := client.sent[1].Level; got != "" {
+		t.Errorf("expected no level, got %q", got)
+	}
+}
+
+func TestLogDryRun(t *testing.T) {
+	var buf bytes.Buffer
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{DryRun: true}, client)
+	l.logger = zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewDevelopmentEncoderConfig()), zapcore.AddSync(&buf), zap.DebugLevel))
+
+	if err := l.Log(&logger.Message{Line: []byte("dry line"), Timestamp: time.Now()}); err != nil {
+		t.Fatalf("failed to log: %v", err)
+	}
+	if len(client.sent) != 0 {
+		t.Fatalf("expected no message to be sent, got %d", len(client.sent))
+	}
+	if !strings.Contains(buf.String(), "dry line") {
+		t.Fatalf("expected the log to be logged, got %s", buf.String())
+	}
+}
+
+func TestStats(t *testing.T) {
+	client := &fakeClient{err: errors.New("over producer set maximum blocking time"), stats: ClientStats{Failed: 2, Delivered: 5}}
+	l := newTestLogger(t, loggerConfig{}, client)
+
+	for range 3 {
+		if err := l.Log(&logger.Message{Line: []byte("line")}); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+
+	if got, want := l.Stats(), (LoggerStats{Dropped: 3, Failed: 2, Delivered: 5, Received: 3}); got != want {
+		t.Fatalf("expected stats %+v, got %+v", want, got)
+	}
+}
+
+func TestLogChunks(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{}, client)
+
+	messages := []*logger.Message{
+		{Line: []byte("single")},
+		{Line: []byte("multi "), PLogMetaData: &backend.PartialLogMetaData{ID: "1", Ordinal: 1}},
+		{Line: []byte("chunk "), PLogMetaData: &backend.PartialLogMetaData{ID: "1", Ordinal: 2}},
+		{Line: []byte("line"), PLogMetaData: &backend.PartialLogMetaData{ID: "1", Ordinal: 3, Last: true}},
+	}
+	for _, msg := range messages {
+		if err := l.Log(msg); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+
+	if len(client.sent) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(client.sent))
+	}
+	if got := client.sent[0].Chunks; got != 0 {
+		t.Fatalf("expected no chunks for a single line, got %d", got)
+	}
+	if got := client.sent[1]; got.Text != "multi chunk line" || got.Chunks != 3 {
+		t.Fatalf("expected 3 chunks assembled into %q, got %d chunks into %q", "multi chunk line", got.Chunks, got.Text)
+	}
+}
+
+func TestLogClearsPartialMetadata(t *testing.T) {
+	client := &fakeClient{}
+	l := newTestLogger(t, loggerConfig{PartialLogMaxSize: 8}, client)
+
+	messages := []*logger.Message{
+		{Line: []byte("aaaa"), PLogMetaData: &backend.PartialLogMetaData{ID: "1", Ordinal: 1}},
+		{Line: []byte("bbbb"), PLogMetaData: &backend.PartialLogMetaData{ID: "1", Ordinal: 2}},
+	}
+	for _, msg := range messages {
+		if err := l.Log(msg); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+
+	// The log flushed at the maximum size is a whole line in the local log file.
+	last := messages[len(messages)-1]
+	if string(last.Line) != "aaaabbbb" || last.PLogMetaData != nil {
+		t.Fatalf("expected the assembled log without partial metadata, got %q with %+v", last.Line, last.PLogMetaData)
+	}
+	if len(client.sent) != 1 || client.sent[0].Chunks != 2 {
+		t.Fatalf("expected the log of 2 chunks to be sent, got %+v", client.sent)
+	}
+}
+
+// closeCheckingClient fails the test when a message is sent after it's closed.
+type closeCheckingClient struct {
+	fakeClient
+	t *testing.T
+}
+
+func (c *closeCheckingClient) SendMessage(message logMessage) error {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		c.t.Error("message sent after the client was closed")
+	}
+	return c.fakeClient.SendMessage(message)
+}
+
+func TestLogConcurrentWithClose(t *testing.T) {
+	for range 20 {
+		client := &closeCheckingClient{t: t}
+		l := newTestLogger(t, loggerConfig{}, client)
+
+		var wg sync.WaitGroup
+		for i := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					err := l.Log(&logger.Message{Line: []byte("line"), PLogMetaData: &backend.PartialLogMetaData{ID: fmt.Sprint(i), Last: true}})
+					if errors.Is(err, errLoggerClosed) {
+						return
+					}
+					if err != nil {
+						t.Errorf("failed to log: %v", err)
+						return
+					}
+				}
+			}()
+		}
+
+		time.Sleep(time.Millisecond)
+		if err := l.Close(); err != nil {
+			t.Fatalf("failed to close logger: %v", err)
+		}
+		wg.Wait()
+
+		if !client.closed {
+			t.Fatal("expected client to be closed")
+		}
+	}
+}
+
+func TestMissingTagPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    string
+		wantErr bool
+	}{
+		{policy: "", wantErr: true},
+		{policy: missingTagPolicyError, wantErr: true},
+		{policy: missingTagPolicyEmpty, want: "[] line"},
+		{policy: missingTagPolicyLiteral, want: "[{team}] line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			formatter, err := newMessageFormatter(&ContainerDetails{}, &loggerConfig{Template: "[{team}] {log}", MissingTagPolicy: tt.policy})
+			if tt.wantErr {
+				if !errors.Is(err, errUnknownTag) {
+					t.Fatalf("expected unknown tag error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to create message formatter: %v", err)
+			}
+			if got := formatter.Format(&logger.Message{Line: []byte("line")}); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	_ "time/tzdata" // The plugin rootfs may not ship the time zone database.
 
 	"github.com/docker/docker/daemon/logger"
 	"github.com/docker/go-plugins-helpers/sdk"
@@ -35,6 +37,10 @@ func main() {
 		zap.String("environment", env),
 	)
 
+	if err := validateProxyEnv(); err != nil {
+		zapLogger.Fatal("invalid proxy settings", zap.Error(err))
+	}
+
 	driver := NewDriver(zapLogger)
 
 	sdkHandler := sdk.NewHandler(pluginManifest)
@@ -74,3 +80,21 @@ func newLogger(env string, logLevel string) (*zap.Logger, error) {
 
 	return cfg.Build()
 }
+
+// validateProxyEnv validates the proxy URLs in the environment.
+// The Tencent CLS SDK routes uploads through the proxy from the standard
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables of the plugin,
+// unless the proxy option is set.
+func validateProxyEnv() error {
+	var errs []error
+	for _, key := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+		value := os.Getenv(key)
+		if value == "" {
+			continue
+		}
+		if _, err := parseProxyURL(value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
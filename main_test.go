@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestValidateProxyEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxy   string
+		wantErr bool
+	}{
+		{name: "unset", proxy: ""},
+		{name: "valid", proxy: "http://proxy.internal:3128"},
+		{name: "missing scheme", proxy: "proxy.internal:3128"},
+		{name: "unsupported scheme", proxy: "ftp://proxy.internal:3128", wantErr: true},
+		{name: "malformed", proxy: "http://[::1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HTTP_PROXY", "")
+			t.Setenv("http_proxy", "")
+			t.Setenv("https_proxy", "")
+			t.Setenv("HTTPS_PROXY", tt.proxy)
+
+			if err := validateProxyEnv(); (err != nil) != tt.wantErr {
+				t.Fatalf("expected error=%v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// metricsServers are the metrics servers shared by the loggers with the same metrics-addr option.
+var metricsServers = newMetricsRegistry()
+
+// metricsShutdownTimeout is the maximum time to wait for the scrapes in progress
+// when the last logger of a metrics server is closed.
+const metricsShutdownTimeout = 5 * time.Second
+
+// statsSource is a logger whose counters are exported by a metrics server.
+type statsSource interface {
+	Stats() LoggerStats
+}
+
+// metricsRegistry shares a metrics server between the loggers with the same address.
+// A server is shut down once the last logger using it is unregistered.
+type metricsRegistry struct {
+	mu      sync.Mutex
+	servers map[string]*metricsServer
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		servers: map[string]*metricsServer{},
+	}
+}
+
+// Register exports the counters of the source on the server listening on addr,
+// starting it if no logger uses it yet. The returned function unregisters the source.
+func (r *metricsRegistry) Register(logger *zap.Logger, addr string, source statsSource) (func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	server, ok := r.servers[addr]
+	if !ok {
+		var err error
+		server, err = startMetricsServer(logger, addr)
+		if err != nil {
+			return nil, err
+		}
+		r.servers[addr] = server
+	}
+	server.collector.add(source)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { r.unregister(addr, server, source) })
+	}, nil
+}
+
+func (r *metricsRegistry) unregister(addr string, server *metricsServer, source statsSource) {
+	r.mu.Lock()
+	last := server.collector.remove(source)
+	if last {
+		delete(r.servers, addr)
+	}
+	r.mu.Unlock()
+
+	if last {
+		server.shutdown()
+	}
+}
+
+// metricsServer serves the counters of its loggers in the Prometheus format.
+type metricsServer struct {
+	server    *http.Server
+	listener  net.Listener
+	collector *statsCollector
+	logger    *zap.Logger
+}
+
+func startMetricsServer(logger *zap.Logger, addr string) (*metricsServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	collector := newStatsCollector()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	s := &metricsServer{
+		server:    &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+		listener:  listener,
+		collector: collector,
+		logger:    logger,
+	}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("metrics server failed", zap.String("addr", addr), zap.Error(err))
+		}
+	}()
+	return s, nil
+}
+
+func (s *metricsServer) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.logger.Warn("failed to shut down metrics server", zap.Error(err))
+	}
+}
+
+var (
+	receivedDesc = prometheus.NewDesc("tencent_cls_logs_received_total",
+		"Number of logs received from the containers.", nil, nil)
+	deliveredDesc = prometheus.NewDesc("tencent_cls_logs_sent_total",
+		"Number of logs uploaded to Tencent CLS.", nil, nil)
+	droppedDesc = prometheus.NewDesc("tencent_cls_logs_dropped_total",
+		"Number of logs the client refused to send, e.g. when the producer buffer is full.", nil, nil)
+	abandonedDesc = prometheus.NewDesc("tencent_cls_logs_abandoned_total",
+		"Number of logs whose send was given up on a full producer buffer, past the send deadline or on close.", nil, nil)
+	failedDesc = prometheus.NewDesc("tencent_cls_logs_failed_total",
+		"Number of logs which failed to be uploaded after exhausting the retries.", nil, nil)
+	sampledDesc = prometheus.NewDesc("tencent_cls_logs_sampled_total",
+		"Number of logs dropped by the sampling.", nil, nil)
+	bytesDesc = prometheus.NewDesc("tencent_cls_sent_bytes_total",
+		"Size in bytes of the logs handed to the producer.", nil, nil)
+	bufferDepthDesc = prometheus.NewDesc("tencent_cls_buffer_depth",
+		"Number of logs queued in the producer and not yet acknowledged by Tencent CLS.", nil, nil)
+)
+
+// statsCollector sums the counters of the loggers of a metrics server.
+// The counters of the unregistered loggers are kept so the totals never decrease.
+type statsCollector struct {
+	mu      sync.Mutex
+	sources map[statsSource]struct{}
+	retired LoggerStats
+}
+
+func newStatsCollector() *statsCollector {
+	return &statsCollector{
+		sources: map[statsSource]struct{}{},
+	}
+}
+
+func (c *statsCollector) add(source statsSource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sources[source] = struct{}{}
+}
+
+// remove unregisters the source and returns whether it was the last one.
+func (c *statsCollector) remove(source statsSource) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sources, source)
+	stats := source.Stats()
+	c.retired.Received += stats.Received
+	c.retired.Delivered += stats.Delivered
+	c.retired.Dropped += stats.Dropped
+	c.retired.Abandoned += stats.Abandoned
+	c.retired.Failed += stats.Failed
+	c.retired.Bytes += stats.Bytes
+	c.retired.Sampled += stats.Sampled
+	return len(c.sources) == 0
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- receivedDesc
+	ch <- deliveredDesc
+	ch <- droppedDesc
+	ch <- abandonedDesc
+	ch <- failedDesc
+	ch <- sampledDesc
+	ch <- bytesDesc
+	ch <- bufferDepthDesc
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	total := c.retired
+	for source := range c.sources {
+		stats := source.Stats()
+		total.Received += stats.Received
+		total.Delivered += stats.Delivered
+		total.Dropped += stats.Dropped
+		total.Abandoned += stats.Abandoned
+		total.Failed += stats.Failed
+		total.Bytes += stats.Bytes
+		total.Sampled += stats.Sampled
+		total.Pending += stats.Pending
+	}
+	c.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(receivedDesc, prometheus.CounterValue, float64(total.Received))
+	ch <- prometheus.MustNewConstMetric(deliveredDesc, prometheus.CounterValue, float64(total.Delivered))
+	ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(total.Dropped))
+	ch <- prometheus.MustNewConstMetric(abandonedDesc, prometheus.CounterValue, float64(total.Abandoned))
+	ch <- prometheus.MustNewConstMetric(failedDesc, prometheus.CounterValue, float64(total.Failed))
+	ch <- prometheus.MustNewConstMetric(sampledDesc, prometheus.CounterValue, float64(total.Sampled))
+	ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.CounterValue, float64(total.Bytes))
+	ch <- prometheus.MustNewConstMetric(bufferDepthDesc, prometheus.GaugeValue, float64(total.Pending))
+}
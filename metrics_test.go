@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"go.uber.org/zap"
+)
+
+type fakeStatsSource struct {
+	stats LoggerStats
+}
+
+func (s *fakeStatsSource) Stats() LoggerStats {
+	return s.stats
+}
+
+func scrapeMetrics(t *testing.T, addr string) map[string]*dto.MetricFamily {
+	t.Helper()
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to parse metrics: %v", err)
+	}
+	return families
+}
+
+func metricValue(t *testing.T, families map[string]*dto.MetricFamily, name string) float64 {
+	t.Helper()
+
+	family, ok := families[name]
+	if !ok || len(family.GetMetric()) != 1 {
+		t.Fatalf("expected a single %s metric, got %v", name, family)
+	}
+	metric := family.GetMetric()[0]
+	if family.GetType() == dto.MetricType_GAUGE {
+		return metric.GetGauge().GetValue()
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestMetricsServer(t *testing.T) {
+	registry := newMetricsRegistry()
+	first := &fakeStatsSource{stats: LoggerStats{Received: 5, Delivered: 3, Dropped: 1, Abandoned: 2, Bytes: 300, Pending: 1}}
+	second := &fakeStatsSource{stats: LoggerStats{Received: 2, Delivered: 1, Failed: 1, Bytes: 100, Pending: 2}}
+
+	unregisterFirst, err := registry.Register(zap.NewNop(), "127.0.0.1:0", first)
+	if err != nil {
+		t.Fatalf("failed to register metrics: %v", err)
+	}
+	unregisterSecond, err := registry.Register(zap.NewNop(), "127.0.0.1:0", second)
+	if err != nil {
+		t.Fatalf("failed to register metrics: %v", err)
+	}
+	if len(registry.servers) != 1 {
+		t.Fatalf("expected a single shared server, got %d", len(registry.servers))
+	}
+	addr := registry.servers["127.0.0.1:0"].listener.Addr().String()
+
+	families := scrapeMetrics(t, addr)
+	for name, want := range map[string]float64{
+		"tencent_cls_logs_received_total":  7,
+		"tencent_cls_logs_sent_total":      4,
+		"tencent_cls_logs_dropped_total":   1,
+		"tencent_cls_logs_abandoned_total": 2,
+		"tencent_cls_logs_failed_total":    1,
+		"tencent_cls_sent_bytes_total":     400,
+		"tencent_cls_buffer_depth":         3,
+	} {
+		if got := metricValue(t, families, name); got != want {
+			t.Errorf("expected %s %v, got %v", name, want, got)
+		}
+	}
+
+	// The counters of a closed logger are kept, unlike its buffer depth.
+	unregisterFirst()
+	families = scrapeMetrics(t, addr)
+	if got := metricValue(t, families, "tencent_cls_logs_received_total"); got != 7 {
+		t.Errorf("expected received logs to be kept, got %v", got)
+	}
+	if got := metricValue(t, families, "tencent_cls_buffer_depth"); got != 2 {
+		t.Errorf("expected buffer depth 2, got %v", got)
+	}
+
+	unregisterSecond()
+	if len(registry.servers) != 0 {
+		t.Fatalf("expected the server to be shut down, got %d", len(registry.servers))
+	}
+	if _, err := http.Get("http://" + addr + "/metrics"); err == nil {
+		t.Fatal("expected the server to be closed")
+	}
+}
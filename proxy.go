@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"unsafe"
+
+	tencentcloud_cls_sdk_go "github.com/tencentcloud/tencentcloud-cls-sdk-go"
+)
+
+// proxySchemes are the proxy schemes supported by the HTTP transport.
+var proxySchemes = []string{"http", "https", "socks5"}
+
+// parseProxyURL parses a proxy URL like http.ProxyFromEnvironment does,
+// a proxy without a scheme being an HTTP one, e.g. proxy.internal:3128.
+func parseProxyURL(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(proxySchemes, u.Scheme) {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %q has no host", proxy)
+	}
+	return u, nil
+}
+
+// redactProxy masks the password of the proxy URL, if any.
+func redactProxy(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return maskSecret(proxy)
+	}
+	return u.Redacted()
+}
+
+// setProxy routes the uploads of the Tencent CLS client through the proxy
+// instead of the proxy of the environment.
+//
+// The SDK doesn't allow configuring the HTTP client it creates, so its
+// transport is patched, which must be done before the client sends anything.
+func setProxy(clsClient *tencentcloud_cls_sdk_go.CLSClient, proxy string) error {
+	proxyURL, err := parseProxyURL(proxy)
+	if err != nil {
+		return err
+	}
+
+	field := reflect.ValueOf(clsClient).Elem().FieldByName("client")
+	if !field.IsValid() || field.Type() != reflect.TypeFor[*http.Client]() {
+		return errors.New("unsupported Tencent CLS SDK client")
+	}
+	httpClient := reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Interface().(*http.Client)
+	transport, ok := httpClient.Transport.(*http.Transport)
+	if !ok {
+		return errors.New("unsupported Tencent CLS SDK transport")
+	}
+	transport.Proxy = http.ProxyURL(proxyURL)
+	return nil
+}
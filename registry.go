@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	tencentcloud_cls_sdk_go "github.com/tencentcloud/tencentcloud-cls-sdk-go"
+)
+
+// sharedProducers are the producers shared by the clients with the share-producer option.
+var sharedProducers = newProducerRegistry(newAsyncProducer)
+
+// newAsyncProducer creates and starts a Tencent CLS producer,
+// uploading through the proxy unless it's empty.
+func newAsyncProducer(producerConfig *tencentcloud_cls_sdk_go.AsyncProducerClientConfig, proxy string) (producer, error) {
+	producerInstance, err := tencentcloud_cls_sdk_go.NewAsyncProducerClient(producerConfig)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != "" {
+		if err := setProxy(producerInstance.Client, proxy); err != nil {
+			return nil, fmt.Errorf("failed to set proxy: %w", err)
+		}
+	}
+	producerInstance.Start()
+	return producerInstance, nil
+}
+
+// producerRegistry shares a producer between the clients with identical
+// producer configs, i.e. the same endpoint, credentials and tuning,
+// and the same proxy.
+// A producer is closed once the last client using it is closed.
+type producerRegistry struct {
+	mu          sync.Mutex
+	producers   map[producerKey]*sharedProducer
+	newProducer func(*tencentcloud_cls_sdk_go.AsyncProducerClientConfig, string) (producer, error)
+}
+
+// producerKey identifies the producers which can be shared.
+type producerKey struct {
+	config tencentcloud_cls_sdk_go.AsyncProducerClientConfig
+	proxy  string
+}
+
+func newProducerRegistry(newProducer func(*tencentcloud_cls_sdk_go.AsyncProducerClientConfig, string) (producer, error)) *producerRegistry {
+	return &producerRegistry{
+		producers:   map[producerKey]*sharedProducer{},
+		newProducer: newProducer,
+	}
+}
+
+// Acquire returns the producer for the config and proxy, creating it if no client uses it yet.
+// The returned producer must be closed to release it.
+func (r *producerRegistry) Acquire(producerConfig *tencentcloud_cls_sdk_go.AsyncProducerClientConfig, proxy string) (producer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := producerKey{config: *producerConfig, proxy: proxy}
+	if shared, ok := r.producers[key]; ok {
+		shared.refs++
+		return &sharedProducerRef{sharedProducer: shared}, nil
+	}
+
+	// The producer fills in the defaults of the config it is given,
+	// so it gets a copy to keep the key intact.
+	config := key.config
+	p, err := r.newProducer(&config, proxy)
+	if err != nil {
+		return nil, err
+	}
+	shared := &sharedProducer{producer: p, registry: r, key: key, refs: 1}
+	r.producers[shared.key] = shared
+	return &sharedProducerRef{sharedProducer: shared}, nil
+}
+
+func (r *producerRegistry) release(shared *sharedProducer, timeoutMs int64) error {
+	r.mu.Lock()
+	shared.refs--
+	last := shared.refs == 0
+	if last {
+		delete(r.producers, shared.key)
+	}
+	r.mu.Unlock()
+
+	if !last {
+		// The logs of the client are still uploaded by the producer.
+		return nil
+	}
+	return shared.producer.Close(timeoutMs)
+}
+
+// sharedProducer is a producer used by several clients.
+type sharedProducer struct {
+	producer
+	registry *producerRegistry
+	key      producerKey
+	refs     int
+}
+
+// sharedProducerRef is the reference of a client to a shared producer.
+type sharedProducerRef struct {
+	*sharedProducer
+	once sync.Once
+}
+
+// Close releases the producer, closing it if the client was the last to use it.
+func (p *sharedProducerRef) Close(timeoutMs int64) (err error) {
+	p.once.Do(func() {
+		err = p.registry.release(p.sharedProducer, timeoutMs)
+	})
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	tencentcloud_cls_sdk_go "github.com/tencentcloud/tencentcloud-cls-sdk-go"
+)
+
+func TestProducerRegistryShares(t *testing.T) {
+	var created []*fakeProducer
+	registry := newProducerRegistry(func(*tencentcloud_cls_sdk_go.AsyncProducerClientConfig, string) (producer, error) {
+		p := &fakeProducer{}
+		created = append(created, p)
+		return p, nil
+	})
+
+	cfg := ClientConfig{Endpoint: "ap-guangzhou.cls.tencentcs.com", SecretID: "id", SecretKey: "key"}
+	first, err := registry.Acquire(newProducerConfig(cfg), cfg.Proxy)
+	if err != nil {
+		t.Fatalf("failed to acquire producer: %v", err)
+	}
+	second, err := registry.Acquire(newProducerConfig(cfg), cfg.Proxy)
+	if err != nil {
+		t.Fatalf("failed to acquire producer: %v", err)
+	}
+	cfg.Endpoint = "ap-shanghai.cls.tencentcs.com"
+	other, err := registry.Acquire(newProducerConfig(cfg), cfg.Proxy)
+	if err != nil {
+		t.Fatalf("failed to acquire producer: %v", err)
+	}
+
+	if len(created) != 2 {
+		t.Fatalf("expected 2 producers for 2 endpoints, got %d", len(created))
+	}
+
+	// Closing a reference twice must not release the producer of the other client.
+	for range 2 {
+		if err := first.Close(1000); err != nil {
+			t.Fatalf("failed to close producer: %v", err)
+		}
+	}
+	if created[0].closed {
+		t.Fatal("expected shared producer to stay open while used")
+	}
+	if err := second.Close(1000); err != nil {
+		t.Fatalf("failed to close producer: %v", err)
+	}
+	if !created[0].closed || created[0].closeTimeoutMs != 1000 {
+		t.Fatal("expected shared producer to be closed by its last client")
+	}
+	if created[1].closed {
+		t.Fatal("expected producer of the other endpoint to stay open")
+	}
+	if err := other.Close(1000); err != nil {
+		t.Fatalf("failed to close producer: %v", err)
+	}
+	if len(registry.producers) != 0 {
+		t.Fatalf("expected registry to be empty, got %d producers", len(registry.producers))
+	}
+
+	// A producer is created again once all its clients are closed.
+	if _, err := registry.Acquire(newProducerConfig(cfg), cfg.Proxy); err != nil {
+		t.Fatalf("failed to acquire producer: %v", err)
+	}
+	if len(created) != 3 {
+		t.Fatalf("expected a new producer, got %d producers", len(created))
+	}
+}
+
+func TestProducerRegistrySeparatesProxies(t *testing.T) {
+	proxies := map[*fakeProducer]string{}
+	registry := newProducerRegistry(func(_ *tencentcloud_cls_sdk_go.AsyncProducerClientConfig, proxy string) (producer, error) {
+		p := &fakeProducer{}
+		proxies[p] = proxy
+		return p, nil
+	})
+
+	cfg := ClientConfig{Endpoint: "ap-guangzhou.cls.tencentcs.com", SecretID: "id", SecretKey: "key"}
+	if _, err := registry.Acquire(newProducerConfig(cfg), ""); err != nil {
+		t.Fatalf("failed to acquire producer: %v", err)
+	}
+	if _, err := registry.Acquire(newProducerConfig(cfg), "http://proxy.internal:3128"); err != nil {
+		t.Fatalf("failed to acquire producer: %v", err)
+	}
+
+	if len(proxies) != 2 {
+		t.Fatalf("expected a producer per proxy, got %d producers", len(proxies))
+	}
+}
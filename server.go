@@ -95,7 +95,9 @@ func (s *Server) startLoggingHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.zapLogger.Debug("start logging request was called for the container", zap.Any("req", req))
+	redactedReq := req
+	redactedReq.Info = *redactContainerDetails(&req.Info)
+	s.zapLogger.Debug("start logging request was called for the container", zap.Any("req", redactedReq))
 
 	s.writeResponse(w, http.StatusOK, nil)
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	tencentcloud_cls_sdk_go "github.com/tencentcloud/tencentcloud-cls-sdk-go"
+)
+
+const (
+	// outputSinkCLS sends logs to Tencent CLS.
+	outputSinkCLS = "cls"
+	// outputSinkStdoutJSON writes logs to the plugin's stdout as JSON lines.
+	outputSinkStdoutJSON = "stdout-json"
+)
+
+// jsonLinesProducer is a producer that writes every log as a single JSON object
+// per line instead of sending it to Tencent CLS.
+type jsonLinesProducer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var _ producer = (*jsonLinesProducer)(nil)
+
+func newJSONLinesProducer(w io.Writer) *jsonLinesProducer {
+	return &jsonLinesProducer{w: w}
+}
+
+// SendLog writes the log contents and time to the underlying writer.
+func (p *jsonLinesProducer) SendLog(_ string, log *tencentcloud_cls_sdk_go.Log, callback tencentcloud_cls_sdk_go.CallBack) error {
+	record := make(map[string]any, len(log.GetContents())+1)
+	for _, content := range log.GetContents() {
+		record[content.GetKey()] = content.GetValue()
+	}
+	record["__time__"] = log.GetTime()
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal log: %w", err)
+	}
+	b = append(b, '\n')
+
+	p.mu.Lock()
+	_, err = p.w.Write(b)
+	p.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to write log: %w", err)
+	}
+
+	if callback != nil {
+		callback.Success(tencentcloud_cls_sdk_go.NewResult())
+	}
+	return nil
+}
+
+// Close implements the producer interface. There is nothing to flush.
+func (p *jsonLinesProducer) Close(int64) error {
+	return nil
+}
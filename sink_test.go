@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestJSONLinesProducer(t *testing.T) {
+	var buf bytes.Buffer
+	client := newClient(zap.NewNop(), ClientConfig{OutputSink: outputSinkStdoutJSON}, newJSONLinesProducer(&buf))
+
+	for _, line := range []string{`{"a": "b"}`, "plain"} {
+		if err := client.SendMessage(logMessage{Text: line}); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+	}
+
+	var records []map[string]any
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid json line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if records[0]["a"] != "b" {
+		t.Errorf("expected field a=b, got %v", records[0]["a"])
+	}
+	if records[1]["__original_text__"] != "plain" {
+		t.Errorf("expected original text, got %v", records[1]["__original_text__"])
+	}
+	if client.pending.Load() != 0 {
+		t.Errorf("expected no pending logs, got %d", client.pending.Load())
+	}
+}
+
+func TestNewClientStdoutJSONSkipsCLS(t *testing.T) {
+	cfg := ClientConfig{OutputSink: outputSinkStdoutJSON}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected config without CLS settings to be valid: %v", err)
+	}
+
+	client, err := NewClient(zap.NewNop(), cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if _, ok := client.producer.(*jsonLinesProducer); !ok {
+		t.Fatalf("expected json lines producer, got %T", client.producer)
+	}
+}
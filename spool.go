@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// spoolSegments is the number of segments the spool size is divided into,
+	// the granularity at which the oldest logs are dropped when the spool is full.
+	spoolSegments = 8
+
+	spoolSegmentExt = ".jsonl"
+
+	// spoolOffsetFile is the file the replay offset is saved to, so that
+	// the spool resumes past the logs already replayed once reopened.
+	spoolOffsetFile = "offset"
+
+	// spoolReplayInterval is the interval to try replaying the spooled logs.
+	spoolReplayInterval = 10 * time.Second
+)
+
+// spool is a bounded on-disk queue of the logs the client failed to send,
+// stored as JSON lines in numbered segment files.
+type spool struct {
+	mu     sync.Mutex
+	logger *zap.Logger
+
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	// segments are the sequence numbers of the segment files, oldest first.
+	// The last one is appended to.
+	segments []int64
+	// size is the total size of the segment files.
+	size int64
+	// offset is the position in the oldest segment up to which
+	// the logs were replayed.
+	offset int64
+}
+
+// newSpool opens the spool in dir, creating it if needed, and picks up
+// the segments left over from a previous run.
+func newSpool(logger *zap.Logger, dir string, maxSize int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	s := &spool{
+		logger:      logger,
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: max(maxSize/spoolSegments, 1),
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), spoolSegmentExt)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		seq, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat spool segment: %w", err)
+		}
+		s.segments = append(s.segments, seq)
+		s.size += info.Size()
+	}
+	slices.Sort(s.segments)
+
+	if err := s.loadOffset(); err != nil {
+		logger.Warn("replaying the spool from the start", zap.String("dir", dir), zap.Error(err))
+	}
+
+	return s, nil
+}
+
+// loadOffset restores the replay offset saved for the oldest segment.
+// An offset saved for another segment, which was dropped or replayed
+// since, is ignored.
+func (s *spool) loadOffset() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, spoolOffsetFile))
+	if errors.Is(err, os.ErrNotExist) || len(s.segments) == 0 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read spool offset: %w", err)
+	}
+
+	var seq, offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &seq, &offset); err != nil {
+		return fmt.Errorf("failed to parse spool offset: %w", err)
+	}
+	if seq != s.segments[0] {
+		return nil
+	}
+	info, err := os.Stat(s.segmentPath(seq))
+	if err != nil {
+		return fmt.Errorf("failed to stat spool segment: %w", err)
+	}
+	if offset < 0 || offset > info.Size() {
+		return fmt.Errorf("spool offset %d out of the segment", offset)
+	}
+	s.offset = offset
+	return nil
+}
+
+// saveOffset saves the replay offset of the oldest segment.
+// It must be called with the lock held.
+func (s *spool) saveOffset() error {
+	if len(s.segments) == 0 {
+		return nil
+	}
+
+	// The offset is renamed into place, so that a crash leaves either
+	// the previous offset or the new one.
+	path := filepath.Join(s.dir, spoolOffsetFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", s.segments[0], s.offset)), 0o600); err != nil {
+		return fmt.Errorf("failed to write spool offset: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to save spool offset: %w", err)
+	}
+	return nil
+}
+
+func (s *spool) segmentPath(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSegmentExt))
+}
+
+// Len returns the number of bytes waiting to be replayed.
+func (s *spool) Len() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size - s.offset
+}
+
+// Append writes the log at the end of the spool, dropping the oldest
+// segments when the spool exceeds its maximum size.
+func (s *spool) Append(msg logMessage) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal spooled log: %w", err)
+	}
+	line = append(line, '\n')
+
+	if int64(len(line)) > s.maxSize {
+		return fmt.Errorf("log of %d bytes exceeds the spool size", len(line))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.segments) == 0 || s.segmentFull(s.segments[len(s.segments)-1]) {
+		var seq int64
+		if len(s.segments) > 0 {
+			seq = s.segments[len(s.segments)-1] + 1
+		}
+		s.segments = append(s.segments, seq)
+	}
+
+	f, err := os.OpenFile(s.segmentPath(s.segments[len(s.segments)-1]), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	n, err := f.Write(line)
+	s.size += int64(n)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write spool segment: %w", err)
+	}
+
+	for s.size > s.maxSize && len(s.segments) > 1 {
+		if err := s.dropOldest(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *spool) segmentFull(seq int64) bool {
+	info, err := os.Stat(s.segmentPath(seq))
+	return err == nil && info.Size() >= s.segmentSize
+}
+
+// dropOldest removes the oldest segment with the logs left to replay in it.
+func (s *spool) dropOldest() error {
+	path := s.segmentPath(s.segments[0])
+	info, err := os.Stat(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to stat spool segment: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove spool segment: %w", err)
+	}
+
+	var size int64
+	if info != nil {
+		size = info.Size()
+	}
+	s.logger.Warn("spool is full, dropping oldest logs", zap.String("segment", path), zap.Int64("size", size-s.offset))
+
+	s.segments = s.segments[1:]
+	s.size -= size
+	s.offset = 0
+	return nil
+}
+
+// Replay sends the spooled logs oldest first, stopping at the first log
+// which fails to be sent so that it is retried on the next replay,
+// and saving the replay offset then.
+// The lock isn't held while sending, so that the logs failing to be sent
+// meanwhile can still be spooled.
+func (s *spool) Replay(send func(logMessage) error) error {
+	for {
+		s.mu.Lock()
+		if len(s.segments) == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		seq := s.segments[0]
+		data, err := s.readSegment(seq)
+		if err == nil && len(data) == 0 {
+			err = s.removeOldest()
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		if !s.replayLines(seq, data, send) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.saveOffset()
+		}
+	}
+}
+
+// readSegment returns the content of the segment from the replay offset on.
+func (s *spool) readSegment(seq int64) ([]byte, error) {
+	f, err := os.Open(s.segmentPath(seq))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(s.offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek spool segment: %w", err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool segment: %w", err)
+	}
+	return data, nil
+}
+
+// removeOldest removes the oldest segment once all its logs are replayed.
+func (s *spool) removeOldest() error {
+	path := s.segmentPath(s.segments[0])
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove spool segment: %w", err)
+	}
+	s.segments = s.segments[1:]
+	s.size -= s.offset
+	s.offset = 0
+	return nil
+}
+
+// replayLines sends the logs read from the segment, moving the replay offset
+// past each one sent. It reports whether the replay should go on, which is
+// not the case once a log fails to be sent.
+func (s *spool) replayLines(seq int64, data []byte, send func(logMessage) error) bool {
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+
+		// A partial line is the tail of an interrupted write.
+		if line[len(line)-1] == '\n' {
+			var msg logMessage
+			if err := json.Unmarshal(line, &msg); err != nil {
+				s.logger.Warn("skipping corrupted spooled log", zap.String("segment", s.segmentPath(seq)), zap.Error(err))
+			} else if err := send(msg); err != nil {
+				return false
+			}
+		}
+
+		if !s.advance(seq, int64(len(line))) {
+			// The segment was dropped while sending, the replay goes on
+			// with the oldest segment left.
+			return true
+		}
+	}
+	return true
+}
+
+// advance moves the replay offset of the segment by n bytes,
+// reporting false if the segment was dropped meanwhile.
+func (s *spool) advance(seq int64, n int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.segments) == 0 || s.segments[0] != seq {
+		return false
+	}
+	s.offset += n
+	return true
+}
+
+// Close saves the replay offset, or removes the spool directory if no log
+// is left to replay, so that the directories of the removed containers
+// don't pile up.
+func (s *spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.segments) > 0 {
+		return s.saveOffset()
+	}
+	if err := os.Remove(filepath.Join(s.dir, spoolOffsetFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove spool offset: %w", err)
+	}
+	if err := os.Remove(s.dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove spool directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/docker/docker/daemon/logger"
+	"go.uber.org/zap"
+)
+
+func TestSpoolReplaysAfterRecovery(t *testing.T) {
+	s, err := newSpool(zap.NewNop(), t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatalf("failed to create spool: %v", err)
+	}
+
+	client := &fakeClient{err: errors.New("over producer set maximum blocking time")}
+	l := newTestLogger(t, loggerConfig{}, client)
+	l.spool = s
+
+	for _, line := range []string{"first", "second", "third"} {
+		if err := l.Log(&logger.Message{Line: []byte(line)}); err != nil {
+			t.Fatalf("failed to log: %v", err)
+		}
+	}
+	if got := l.Stats().Dropped; got != 0 {
+		t.Fatalf("expected spooled logs not to be dropped, got %d", got)
+	}
+
+	if err := s.Replay(client.SendMessage); err != nil {
+		t.Fatalf("failed to replay spool while failing: %v", err)
+	}
+	if len(client.sent) != 0 {
+		t.Fatalf("expected no log to be replayed while failing, got %d", len(client.sent))
+	}
+
+	client.err = nil
+	if err := s.Replay(client.SendMessage); err != nil {
+		t.Fatalf("failed to replay spool: %v", err)
+	}
+	if want := []string{"first", "second", "third"}; !slices.Equal(client.messages, want) {
+		t.Fatalf("expected replayed logs %v, got %v", want, client.messages)
+	}
+	if got := s.Len(); got != 0 {
+		t.Fatalf("expected spool to be empty, got %d bytes", got)
+	}
+}
+
+func TestSpoolDropsOldestSegments(t *testing.T) {
+	s, err := newSpool(zap.NewNop(), t.TempDir(), 1024)
+	if err != nil {
+		t.Fatalf("failed to create spool: %v", err)
+	}
+
+	for i := range 100 {
+		if err := s.Append(logMessage{Text: fmt.Sprintf("line %d", i)}); err != nil {
+			t.Fatalf("failed to append to spool: %v", err)
+		}
+	}
+	if got := s.Len(); got > 1024 {
+		t.Fatalf("expected spool to be capped at 1024 bytes, got %d", got)
+	}
+
+	var replayed []string
+	err = s.Replay(func(msg logMessage) error {
+		replayed = append(replayed, msg.Text)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to replay spool: %v", err)
+	}
+	if len(replayed) == 0 || replayed[len(replayed)-1] != "line 99" || replayed[0] == "line 0" {
+		t.Fatalf("expected only the newest logs to be kept, got %v", replayed)
+	}
+}
+
+func TestSpoolResumesFromDisk(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newSpool(zap.NewNop(), dir, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to create spool: %v", err)
+	}
+	for _, text := range []string{"a", "b", "c"} {
+		if err := s.Append(logMessage{Text: text}); err != nil {
+			t.Fatalf("failed to append to spool: %v", err)
+		}
+	}
+
+	// Replay a single log before the spool is reopened.
+	sendOne := func() func(logMessage) error {
+		sent := false
+		return func(logMessage) error {
+			if sent {
+				return errors.New("unreachable")
+			}
+			sent = true
+			return nil
+		}
+	}()
+	if err := s.Replay(sendOne); err != nil {
+		t.Fatalf("failed to replay spool: %v", err)
+	}
+
+	s, err = newSpool(zap.NewNop(), dir, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to reopen spool: %v", err)
+	}
+	var replayed []string
+	err = s.Replay(func(msg logMessage) error {
+		replayed = append(replayed, msg.Text)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to replay spool: %v", err)
+	}
+	if want := []string{"b", "c"}; !slices.Equal(replayed, want) {
+		t.Fatalf("expected replayed logs %v, got %v", want, replayed)
+	}
+}
+
+func TestSpoolAppendsWhileReplaying(t *testing.T) {
+	s, err := newSpool(zap.NewNop(), t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatalf("failed to create spool: %v", err)
+	}
+	if err := s.Append(logMessage{Text: "a"}); err != nil {
+		t.Fatalf("failed to append to spool: %v", err)
+	}
+
+	// The send failing spools the log again, as sendContext does.
+	err = s.Replay(func(msg logMessage) error {
+		if err := s.Append(logMessage{Text: msg.Text + " again"}); err != nil {
+			t.Fatalf("failed to append to spool while replaying: %v", err)
+		}
+		return errors.New("over producer set maximum blocking time")
+	})
+	if err != nil {
+		t.Fatalf("failed to replay spool: %v", err)
+	}
+
+	var replayed []string
+	err = s.Replay(func(msg logMessage) error {
+		replayed = append(replayed, msg.Text)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to replay spool: %v", err)
+	}
+	if want := []string{"a", "a again"}; !slices.Equal(replayed, want) {
+		t.Fatalf("expected replayed logs %v, got %v", want, replayed)
+	}
+}
+
+func TestSpoolCloseRemovesEmptyDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "container")
+	s, err := newSpool(zap.NewNop(), dir, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to create spool: %v", err)
+	}
+	if err := s.Append(logMessage{Text: "a"}); err != nil {
+		t.Fatalf("failed to append to spool: %v", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close spool: %v", err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("expected spool directory with logs left to be kept: %v", err)
+	}
+
+	if err := s.Replay(func(logMessage) error { return nil }); err != nil {
+		t.Fatalf("failed to replay spool: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close spool: %v", err)
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected empty spool directory to be removed, got %v", err)
+	}
+}